@@ -1,5 +1,5 @@
 module github.com/evad1n/mapreduce
 
-go 1.16
+go 1.21
 
 require github.com/mattn/go-sqlite3 v1.14.7
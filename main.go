@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"math"
+	"os"
 	"strconv"
 	"strings"
 	"unicode"
@@ -10,44 +13,149 @@ import (
 )
 
 func main() {
-	var c Client
-	if err := mapreduce.Start(c); err != nil {
+	// ./client.exe pagerank <FLAGS> runs the PageRank example instead of word count
+	if len(os.Args) > 1 && os.Args[1] == "pagerank" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		if err := mapreduce.StartIterative(PageRankJob()); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
+
+	if err := mapreduce.Start(WordCountJob()); err != nil {
 		log.Fatalf("%v", err)
 	}
 }
 
-// Map and Reduce functions for a basic wordcount client
+// WordCountJob counts the words of each line, ignoring case and anything but letters and digits
+func WordCountJob() *mapreduce.TypedJob[string, string, string, int, string, int] {
+	return &mapreduce.TypedJob[string, string, string, int, string, int]{
+		Mapper: func(key, line string, emit func(string, int) error) error {
+			for _, elt := range strings.Fields(line) {
+				word := strings.Map(func(r rune) rune {
+					if unicode.IsLetter(r) || unicode.IsDigit(r) {
+						return unicode.ToLower(r)
+					}
+					return -1
+				}, elt)
+				if len(word) > 0 {
+					if err := emit(word, 1); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+		Reducer: func(word string, counts <-chan int, emit func(string, int) error) error {
+			total := 0
+			for c := range counts {
+				total += c
+			}
+			return emit(word, total)
+		},
+		KeyIn: mapreduce.StringCodec{}, ValueIn: mapreduce.StringCodec{},
+		KeyMid: mapreduce.StringCodec{}, ValueMid: mapreduce.IntCodec{},
+		KeyOut: mapreduce.StringCodec{}, ValueOut: mapreduce.IntCodec{},
+	}
+}
 
-type Client struct{}
+// PageRank over a link graph. Input rows are a page and the pages it links to separated by spaces, optionally
+// preceded by its rank and a tab, which is what each iteration outputs.
 
-func (c Client) Map(key, value string, output chan<- mapreduce.Pair) error {
-	defer close(output)
-	lst := strings.Fields(value)
-	for _, elt := range lst {
-		word := strings.Map(func(r rune) rune {
-			if unicode.IsLetter(r) || unicode.IsDigit(r) {
-				return unicode.ToLower(r)
-			}
-			return -1
-		}, elt)
-		if len(word) > 0 {
-			output <- mapreduce.Pair{Key: word, Value: "1"}
+const (
+	damping       = 0.85
+	rankChange    = "rank change (millionths)"
+	pageCount     = "pages"
+	maxIterations = 30
+	tolerance     = 1e-4 // Average rank change per page below which the ranks have converged
+)
+
+type PageRank struct{}
+
+// PageRankJob iterates until the average rank change per page drops below tolerance
+func PageRankJob() mapreduce.IterativeJob {
+	return mapreduce.IterativeJob{
+		Client:        PageRank{},
+		R:             4,
+		MaxIterations: maxIterations,
+		Converged: func(it *mapreduce.Iteration) (bool, error) {
+			pages := it.Counters[pageCount]
+			return pages > 0 && float64(it.Counters[rankChange])/1e6/float64(pages) < tolerance, nil
+		},
+	}
+}
+
+// Splits a row value into the page's rank (1 if missing) and its links
+func parsePage(value string) (float64, []string, error) {
+	rank := 1.0
+	if r, links, ok := strings.Cut(value, "\t"); ok {
+		var err error
+		if rank, err = strconv.ParseFloat(r, 64); err != nil {
+			return 0, nil, fmt.Errorf("bad rank %q: %v", r, err)
 		}
+		value = links
+	}
+	return rank, strings.Fields(value), nil
+}
+
+// Sends the page's links and old rank to itself, and a share of its rank to every page it links to
+func (p PageRank) Map(key, value string, output chan<- mapreduce.Pair) error {
+	defer close(output)
+	rank, links, err := parsePage(value)
+	if err != nil {
+		return err
+	}
+	output <- mapreduce.Pair{Key: key, Value: "L" + strings.Join(links, " ")}
+	output <- mapreduce.Pair{Key: key, Value: "R" + strconv.FormatFloat(rank, 'g', -1, 64)}
+	for _, link := range links {
+		output <- mapreduce.Pair{Key: link, Value: "C" + strconv.FormatFloat(rank/float64(len(links)), 'g', -1, 64)}
 	}
 	return nil
 }
 
-func (c Client) Reduce(key string, values <-chan string, output chan<- mapreduce.Pair) error {
+func (p PageRank) Reduce(key string, values <-chan string, output chan<- mapreduce.Pair) error {
+	_, err := p.reduce(key, values, output)
+	return err
+}
+
+// Counts how far ranks moved, for the convergence check
+func (p PageRank) ReduceWithContext(ctx *mapreduce.TaskContext, key string, values <-chan string, output chan<- mapreduce.Pair) error {
+	change, err := p.reduce(key, values, output)
+	if err != nil {
+		return err
+	}
+	ctx.Count(pageCount, 1)
+	ctx.Count(rankChange, int64(math.Round(change*1e6)))
+	return nil
+}
+
+// Sums the shares sent to the page into its new rank, returning how much the rank changed
+func (p PageRank) reduce(key string, values <-chan string, output chan<- mapreduce.Pair) (float64, error) {
 	defer close(output)
-	count := 0
+	var links string
+	oldRank, sum := 1.0, 0.0
 	for v := range values {
-		i, err := strconv.Atoi(v)
-		if err != nil {
-			return err
+		if v == "" {
+			return 0, fmt.Errorf("empty value for page %q", key)
+		}
+		switch v[0] {
+		case 'L':
+			links = v[1:]
+		case 'R', 'C':
+			f, err := strconv.ParseFloat(v[1:], 64)
+			if err != nil {
+				return 0, fmt.Errorf("bad rank %q: %v", v[1:], err)
+			}
+			if v[0] == 'R' {
+				oldRank = f
+			} else {
+				sum += f
+			}
+		default:
+			return 0, fmt.Errorf("unknown value %q for page %q", v, key)
 		}
-		count += i
 	}
-	p := mapreduce.Pair{Key: key, Value: strconv.Itoa(count)}
-	output <- p
-	return nil
+	rank := 1 - damping + damping*sum
+	output <- mapreduce.Pair{Key: key, Value: strconv.FormatFloat(rank, 'g', -1, 64) + "\t" + links}
+	return math.Abs(rank - oldRank), nil
 }
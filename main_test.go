@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/evad1n/mapreduce/mapreduce"
+)
+
+func TestWordCount(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "lines.db")
+	lines := []mapreduce.Pair{
+		{Key: "1", Value: "The cat, the hat."},
+		{Key: "2", Value: "A HAT -- 2 hats"},
+	}
+	if err := mapreduce.WriteInput(input, lines); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := mapreduce.RunLocal(mapreduce.Config{InputPath: input, M: 2, R: 2, SortedOutput: true}, WordCountJob())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []mapreduce.Pair{
+		{Key: "2", Value: "1"},
+		{Key: "a", Value: "1"},
+		{Key: "cat", Value: "1"},
+		{Key: "hat", Value: "2"},
+		{Key: "hats", Value: "1"},
+		{Key: "the", Value: "2"},
+	}
+	if !slices.Equal(result.Output, want) {
+		t.Errorf("got %v, want %v", result.Output, want)
+	}
+}
+
+func TestPageRankConverges(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "graph.db")
+	graph := []mapreduce.Pair{
+		{Key: "a", Value: "b c"},
+		{Key: "b", Value: "c"},
+		{Key: "c", Value: "a"},
+		{Key: "d", Value: "c"},
+	}
+	if err := mapreduce.WriteInput(input, graph); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := mapreduce.RunLocalPipeline(mapreduce.Config{InputPath: input, M: 2}, PageRankJob().Stages())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every page counts once per iteration
+	iterations := result.Counters[pageCount] / int64(len(graph))
+	if iterations < 2 || iterations >= maxIterations {
+		t.Errorf("ran %d iterations, want convergence before %d", iterations, maxIterations)
+	}
+
+	ranks := make(map[string]float64)
+	total := 0.0
+	for _, pair := range result.Output {
+		rank, _, _ := strings.Cut(pair.Value, "\t")
+		f, err := strconv.ParseFloat(rank, 64)
+		if err != nil {
+			t.Fatalf("bad output %v: %v", pair, err)
+		}
+		ranks[pair.Key] = f
+		total += f
+	}
+	// Without dangling pages the ranks add up to the number of pages
+	if math.Abs(total-float64(len(graph))) > 0.01 {
+		t.Errorf("ranks add up to %f, want %d", total, len(graph))
+	}
+	if math.Abs(ranks["d"]-(1-damping)) > 1e-9 {
+		t.Errorf("rank of d, which nothing links to, is %f, want %f", ranks["d"], 1-damping)
+	}
+	if ranks["c"] <= ranks["a"] || ranks["a"] <= ranks["b"] {
+		t.Errorf("ranks %v, want c > a > b", ranks)
+	}
+}
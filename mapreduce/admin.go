@@ -0,0 +1,288 @@
+package mapreduce
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+const taskLogLimit = 100 // Number of tasks whose log lines a worker keeps
+
+type (
+	// TaskRef names a task of a job
+	TaskRef struct {
+		Job    string // Defaults to the master's current job
+		Stage  string // Defaults to the master's current pipeline stage
+		Phase  Phase
+		Number int
+	}
+
+	// TaskLog is the history of a task: the master's events and the log lines of the workers that ran it
+	TaskLog struct {
+		Events []Event
+		Lines  []string // Prefixed with the worker address
+	}
+
+	// Keeps a copy of everything logged for a task
+	logBuffer struct {
+		mu  sync.Mutex
+		buf bytes.Buffer
+	}
+
+	// Sends records to two handlers
+	teeHandler struct {
+		a, b slog.Handler
+	}
+)
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Split(strings.TrimSuffix(b.buf.String(), "\n"), "\n")
+}
+
+func (h teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.a.Enabled(ctx, level) || h.b.Enabled(ctx, level)
+}
+
+func (h teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errA, errB error
+	if h.a.Enabled(ctx, r.Level) {
+		errA = h.a.Handle(ctx, r.Clone())
+	}
+	if h.b.Enabled(ctx, r.Level) {
+		errB = h.b.Handle(ctx, r)
+	}
+	return errors.Join(errA, errB)
+}
+
+func (h teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return teeHandler{h.a.WithAttrs(attrs), h.b.WithAttrs(attrs)}
+}
+
+func (h teeHandler) WithGroup(name string) slog.Handler {
+	return teeHandler{h.a.WithGroup(name), h.b.WithGroup(name)}
+}
+
+// Returns a logger that also keeps what is logged for the task on the worker, for the logs command
+func (a NodeActor) captureTaskLog(ref TaskRef, attempt int, logger *slog.Logger) *slog.Logger {
+	buf := &logBuffer{}
+	a.run(func(n *Node) {
+		if n.taskLogs == nil {
+			n.taskLogs = make(map[TaskRef]*logBuffer)
+		}
+		if _, ok := n.taskLogs[ref]; !ok {
+			n.taskLogOrder = append(n.taskLogOrder, ref)
+		} else {
+			// Attempts of the same task share a log
+			buf = n.taskLogs[ref]
+		}
+		n.taskLogs[ref] = buf
+		for len(n.taskLogOrder) > taskLogLimit {
+			delete(n.taskLogs, n.taskLogOrder[0])
+			n.taskLogOrder = n.taskLogOrder[1:]
+		}
+	})
+	capture := slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}).WithAttrs([]slog.Attr{slog.Int("attempt", attempt)})
+	return slog.New(teeHandler{logger.Handler(), capture})
+}
+
+// Status returns a snapshot of the current job
+func (a NodeActor) Status(_ struct{}, status *Status) error {
+	*status = a.status()
+	return nil
+}
+
+// Workers lists the workers connected to the master
+func (a NodeActor) Workers(_ struct{}, workers *[]WorkerStatus) error {
+	*workers = a.status().Workers
+	return nil
+}
+
+// Drain stops giving tasks to a worker and requeues the tasks it is running on other workers
+func (a NodeActor) Drain(addr string, _ *struct{}) error {
+	var err error
+	a.run(func(n *Node) {
+		w, ok := n.Workers[addr]
+		if !ok {
+			err = fmt.Errorf("no worker %q", addr)
+			return
+		}
+		w.Draining = true
+		n.cfg.Logger.Warn("draining worker", "worker", addr)
+		n.requeueFrom(Map, n.MapInfo, addr, "worker drained")
+		n.requeueFrom(Reduce, n.ReduceInfo, addr, "worker drained")
+	})
+	return err
+}
+
+// Takes the running tasks of a phase away from a worker
+func (n *Node) requeueFrom(phase Phase, infos []TaskInfo, addr, reason string) {
+	for i := range infos {
+		if infos[i].State == InProgress {
+			n.dropAttempt(phase, i, addr, reason)
+		}
+	}
+}
+
+// Assigns the tasks of a worker that others can't download from again: the tasks it runs, and the tasks it
+// completed, whose files are still needed by reduce tasks or the merge
+func (n *Node) requeueLost(addr string) {
+	if n.Phase < Map || n.Phase > ReduceDone {
+		return
+	}
+	n.cfg.Logger.Warn("worker unreachable, assigning its tasks again", "worker", addr)
+	n.requeueFrom(Map, n.MapInfo, addr, "worker unreachable")
+	n.requeueFrom(Reduce, n.ReduceInfo, addr, "worker unreachable")
+	n.requeueCompleted(Map, n.MapInfo, addr)
+	n.requeueCompleted(Reduce, n.ReduceInfo, addr)
+}
+
+// Assigns the tasks of a phase a worker completed again
+func (n *Node) requeueCompleted(phase Phase, infos []TaskInfo, addr string) {
+	for i := range infos {
+		if infos[i].State == Completed && infos[i].Worker == addr {
+			n.redo(phase, i, "files lost")
+		}
+	}
+}
+
+// Assigns a completed task again, as its files are lost or corrupt
+func (n *Node) redo(phase Phase, task int, reason string) {
+	// Completed tasks count toward the phase they belong to
+	if phase == Map && n.Phase <= MapDone || phase == Reduce && n.Phase >= Reduce {
+		n.DoneJobs--
+	}
+	n.requeue(phase, task, n.taskInfo(phase, task).Worker, reason)
+}
+
+// Gives up on the attempt of a running task on a worker. The task is assigned again unless the other attempt
+// (the original or its backup) carries on.
+func (n *Node) dropAttempt(phase Phase, task int, addr, reason string) {
+	info := n.taskInfo(phase, task)
+	switch {
+	case info.Backup == addr:
+		info.Backup, info.BackupDone = "", 0
+	case info.Worker != addr:
+	case info.Backup != "":
+		// The backup attempt carries on
+		info.Worker, info.Backup, info.BackupDone = info.Backup, "", 0
+	default:
+		n.requeue(phase, task, addr, reason)
+	}
+}
+
+// Makes a task idle so it is assigned again. Map tasks requeued in the reduce phase run before the remaining
+// reduce tasks.
+func (n *Node) requeue(phase Phase, task int, addr, reason string) {
+	info := n.taskInfo(phase, task)
+	info.State = Idle
+	n.cfg.Logger.Info("task requeued", "phase", phase.String(), "task", task, "worker", addr, "reason", reason)
+	n.events.record(Event{Type: TaskRequeued, Phase: phase.String(), Task: task, Attempt: info.Attempts, Worker: addr, Detail: reason})
+	// Hand the task out again
+	if phase == Map && n.Phase == MapDone {
+		n.setPhase(Map)
+	} else if phase == Reduce && n.Phase == ReduceDone {
+		n.setPhase(Reduce)
+	}
+}
+
+// TaskLogs returns the events of a task of the current job, along with the log lines of the workers that ran it
+func (a NodeActor) TaskLogs(ref TaskRef, log *TaskLog) error {
+	var cfg *Config
+	var workers []string
+	var err error
+	a.run(func(n *Node) {
+		cfg = n.cfg
+		if ref.Job == "" {
+			ref.Job = n.JobID
+		}
+		if ref.Stage == "" {
+			ref.Stage = n.Stage
+		}
+		if ref.Job != n.JobID || n.events == nil {
+			err = fmt.Errorf("no events for job %q, only the current job %q is known", ref.Job, n.JobID)
+			return
+		}
+		if ref.Phase != Map && ref.Phase != Reduce || ref.Stage == n.Stage && n.taskInfo(ref.Phase, ref.Number) == nil {
+			err = fmt.Errorf("no %s task %d", ref.Phase, ref.Number)
+			return
+		}
+
+		seen := make(map[string]bool)
+		for _, e := range n.events.events {
+			if e.Stage != ref.Stage || e.Phase != ref.Phase.String() || e.Task != ref.Number {
+				continue
+			}
+			log.Events = append(log.Events, e)
+			if (e.Type == TaskAssigned || e.Type == TaskReassigned) && !seen[e.Worker] {
+				seen[e.Worker] = true
+				workers = append(workers, e.Worker)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range workers {
+		var lines []string
+		if err := cfg.call(addr, "NodeActor.WorkerTaskLog", ref, &lines); err != nil {
+			log.Lines = append(log.Lines, fmt.Sprintf("%s: no logs: %v", addr, err))
+			continue
+		}
+		for _, line := range lines {
+			log.Lines = append(log.Lines, addr+": "+line)
+		}
+	}
+	return nil
+}
+
+// WorkerTaskLog returns what a worker logged while running a task
+func (a NodeActor) WorkerTaskLog(ref TaskRef, lines *[]string) error {
+	var err error
+	a.run(func(n *Node) {
+		buf, ok := n.taskLogs[ref]
+		if !ok {
+			err = fmt.Errorf("no logs for %s task %d of job %s%s", ref.Phase, ref.Number, ref.Job, stageSuffix(ref.Stage))
+			return
+		}
+		*lines = buf.lines()
+	})
+	return err
+}
+
+// Names a pipeline stage in messages
+func stageSuffix(stage string) string {
+	if stage == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (stage %s)", stage)
+}
+
+// Tasks currently assigned to a worker, like "map 3"
+func (n *Node) workerTasks(addr string) []string {
+	var tasks []string
+	for _, phase := range []Phase{Map, Reduce} {
+		infos := n.MapInfo
+		if phase == Reduce {
+			infos = n.ReduceInfo
+		}
+		for i, info := range infos {
+			if info.State == InProgress && (info.Worker == addr || info.Backup == addr) {
+				tasks = append(tasks, fmt.Sprintf("%s %d", phase, i))
+			}
+		}
+	}
+	return tasks
+}
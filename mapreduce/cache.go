@@ -0,0 +1,269 @@
+package mapreduce
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Names of cache files, which are also part of their URLs
+var cacheNameRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+const sqliteHeader = "SQLite format 3\x00"
+
+type (
+	// CacheFile is a file of the distributed cache, which the master serves to every task of the job
+	CacheFile struct {
+		Name string  // Base name of the file, which tasks look it up by
+		Host string  // Address of the host serving the file
+		File string  // Path of the file on Host
+		Sum  FileSum // Checksum of the file
+	}
+
+	// Cache files downloaded by a node, by job and name, so each is fetched once per job
+	fileCache struct {
+		mu    sync.Mutex
+		files map[string]*cachedFile
+	}
+
+	cachedFile struct {
+		mu     sync.Mutex
+		path   string // Local copy, empty until downloaded
+		lookup bool   // Whether the file is a db with a pairs table, indexed on key
+	}
+
+	// Cache files of a task, with the dbs opened by Lookup
+	taskCache struct {
+		mu    sync.Mutex
+		files map[string]*cachedFile
+		dbs   map[string]*sql.DB
+		stmts map[string]*sql.Stmt
+	}
+)
+
+func newFileCache() *fileCache {
+	return &fileCache{files: make(map[string]*cachedFile)}
+}
+
+// Copies the job's cache files into dir and prepares them to be served like task files, returning them as
+// tasks see them
+func (cfg *Config) serveCacheFiles(dir string) ([]CacheFile, error) {
+	files := make([]CacheFile, len(cfg.CacheFiles))
+	names := make(map[string]bool)
+	for i, src := range cfg.CacheFiles {
+		name := filepath.Base(src)
+		switch {
+		case !cacheNameRegexp.MatchString(name):
+			return nil, fmt.Errorf("cache file name %q must only contain letters, digits, '.', '_' or '-'", name)
+		case names[name]:
+			return nil, fmt.Errorf("two cache files are named %q", name)
+		}
+		names[name] = true
+
+		file := "cache_" + name
+		path := filepath.Join(dir, file)
+		if err := copyFile(src, path); err != nil {
+			return nil, fmt.Errorf("copying cache file %s: %v", src, err)
+		}
+		sum, err := sumFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("checksumming cache file %s: %v", name, err)
+		}
+		if _, err := compressFile(path, cfg.Compression); err != nil {
+			return nil, fmt.Errorf("compressing cache file %s: %v", name, err)
+		}
+		files[i] = CacheFile{Name: name, Host: cfg.Host, File: jobFile(cfg.JobID, "", file), Sum: sum}
+	}
+	if len(files) > 0 {
+		cfg.Logger.Info("serving cache files", "files", len(files))
+	}
+	return files, nil
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Downloads the cache files of a task of job, unless an earlier task of the job already did
+func (cfg *Config) fetchCache(job string, files []CacheFile) (*taskCache, error) {
+	cache := &taskCache{
+		files: make(map[string]*cachedFile),
+		dbs:   make(map[string]*sql.DB),
+		stmts: make(map[string]*sql.Stmt),
+	}
+	for _, file := range files {
+		cfg.cache.mu.Lock()
+		key := job + "/" + file.Name
+		cached, ok := cfg.cache.files[key]
+		if !ok {
+			cached = new(cachedFile)
+			cfg.cache.files[key] = cached
+		}
+		cfg.cache.mu.Unlock()
+
+		if err := cfg.fetchCacheFile(cached, job, file); err != nil {
+			return nil, err
+		}
+		cache.files[file.Name] = cached
+	}
+	return cache, nil
+}
+
+// Downloads a cache file if it isn't yet. A failed download is retried by the next task.
+func (cfg *Config) fetchCacheFile(cached *cachedFile, job string, file CacheFile) error {
+	cached.mu.Lock()
+	defer cached.mu.Unlock()
+	if cached.path != "" {
+		return nil
+	}
+
+	path := filepath.Join(cfg.Tempdir, jobFile(job, "", "cached_"+file.Name))
+	endDownload := cfg.spans.start("download", "file", file.File)
+	err := cfg.downloadVerified(cfg.makeURL(file.Host, file.File), path, file.Sum)
+	endDownload()
+	if err != nil {
+		return fmt.Errorf("downloading cache file %s: %w", file.Name, err)
+	}
+	lookup, err := indexCacheFile(path)
+	if err != nil {
+		return fmt.Errorf("indexing cache file %s: %v", file.Name, err)
+	}
+	cached.path, cached.lookup = path, lookup
+	return nil
+}
+
+// Indexes a downloaded cache file on key if it is a db with a pairs table, and returns whether it is
+func indexCacheFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	header := make([]byte, len(sqliteHeader))
+	_, err = io.ReadFull(f, header)
+	f.Close()
+	if err != nil || !bytes.Equal(header, []byte(sqliteHeader)) {
+		return false, nil
+	}
+
+	db, err := openDatabase(path)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+	var tables int
+	if err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'pairs'").Scan(&tables); err != nil {
+		return false, err
+	}
+	if tables == 0 {
+		return false, nil
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS pairs_cache_key ON pairs (key)"); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Forgets the cache files of a job whose files were removed
+func (c *fileCache) forget(job string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.files {
+		if strings.HasPrefix(key, job+"/") {
+			delete(c.files, key)
+		}
+	}
+}
+
+// CacheFile returns the local path of the named cache file of the job, which is downloaded before the task
+// starts. The file is shared by the tasks of the job on this node, so treat it as read-only.
+func (ctx *TaskContext) CacheFile(name string) (string, error) {
+	if ctx.cache == nil {
+		return "", errors.New("cache files are only available in map and reduce tasks")
+	}
+	cached, ok := ctx.cache.files[name]
+	if !ok {
+		return "", fmt.Errorf("no cache file named %q", name)
+	}
+	return cached.path, nil
+}
+
+// Lookup returns the values of key in the named cache file, which must be a db of pairs like the job input.
+// Values come in the order of the file. Safe for concurrent use.
+func (ctx *TaskContext) Lookup(name, key string) ([]string, error) {
+	if ctx.cache == nil {
+		return nil, errors.New("cache files are only available in map and reduce tasks")
+	}
+	return ctx.cache.lookup(name, key)
+}
+
+func (c *taskCache) lookup(name, key string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stmt, ok := c.stmts[name]
+	if !ok {
+		cached, ok := c.files[name]
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("no cache file named %q", name)
+		case !cached.lookup:
+			return nil, fmt.Errorf("cache file %s is not a db of pairs", name)
+		}
+		db, err := openDatabase(cached.path)
+		if err != nil {
+			return nil, fmt.Errorf("opening cache file %s: %v", name, err)
+		}
+		if stmt, err = db.Prepare("SELECT value FROM pairs WHERE key = ? ORDER BY rowid"); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("preparing lookup statement: %v", err)
+		}
+		c.dbs[name], c.stmts[name] = db, stmt
+	}
+
+	rows, err := stmt.Query(key)
+	if err != nil {
+		return nil, fmt.Errorf("looking up %q in cache file %s: %v", key, name, err)
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, fmt.Errorf("reading a value from cache file %s: %v", name, err)
+		}
+		values = append(values, value)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("looking up %q in cache file %s: %v", key, name, err)
+	}
+	return values, nil
+}
+
+// Closes the dbs opened by Lookup
+func (c *taskCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, db := range c.dbs {
+		c.stmts[name].Close()
+		db.Close()
+	}
+}
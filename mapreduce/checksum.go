@@ -0,0 +1,104 @@
+package mapreduce
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	downloadAttempts = 3 // Downloads failing verification are retried this many times in total
+)
+
+type (
+	// FileSum identifies the exact contents of a produced file
+	FileSum struct {
+		Size   int64
+		SHA256 string
+	}
+
+	// CorruptionError is returned when a downloaded file never matches its checksum
+	CorruptionError struct {
+		URL      string
+		Expected FileSum
+		Got      FileSum
+	}
+
+	// DownloadError is returned when a file can't be downloaded at all, as when the host serving it is gone
+	DownloadError struct {
+		URL string
+		Err error
+	}
+
+	// Corruption is reported to the master when a worker gives up on a corrupt file
+	Corruption struct {
+		Addr     string // Worker that downloaded the file
+		URL      string
+		Expected FileSum
+		Got      FileSum
+	}
+)
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupt download %s: expected %d bytes (sha256 %s), got %d bytes (sha256 %s)", e.URL, e.Expected.Size, e.Expected.SHA256, e.Got.Size, e.Got.SHA256)
+}
+
+func (e *DownloadError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DownloadError) Unwrap() error {
+	return e.Err
+}
+
+// Returns true for the zero FileSum, which means the file is not verified
+func (s FileSum) empty() bool {
+	return s == FileSum{}
+}
+
+// Computes the size and checksum of the file at path
+func sumFile(path string) (FileSum, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FileSum{}, fmt.Errorf("opening file: %v", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return FileSum{}, fmt.Errorf("reading file: %v", err)
+	}
+	return FileSum{Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// Downloads url to dest and verifies it against sum, retrying on failures and mismatches.
+// An empty sum skips verification.
+func (cfg *Config) downloadVerified(url, dest string, sum FileSum) error {
+	var err error
+	for attempt := 1; attempt <= downloadAttempts; attempt++ {
+		if err = cfg.download(url, dest); err != nil {
+			cfg.Logger.Warn("download failed", "url", url, "try", attempt, "of", downloadAttempts, "err", err)
+			continue
+		}
+		if sum.empty() {
+			return nil
+		}
+
+		got, sumErr := sumFile(dest)
+		if sumErr != nil {
+			return fmt.Errorf("checksumming download: %v", sumErr)
+		}
+		if got == sum {
+			return nil
+		}
+		err = &CorruptionError{URL: url, Expected: sum, Got: got}
+		cfg.Logger.Warn("checksum mismatch", "url", url, "try", attempt, "of", downloadAttempts, "err", err)
+	}
+	if _, corrupt := err.(*CorruptionError); !corrupt {
+		return &DownloadError{URL: url, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,77 @@
+package mapreduce
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+type (
+	// Codec converts typed keys and values to and from the strings stored in pairs tables
+	Codec[T any] interface {
+		Encode(T) (string, error)
+		Decode(string) (T, error)
+	}
+
+	// StringCodec passes strings through unchanged
+	StringCodec struct{}
+	// IntCodec stores ints as decimal text (compatible with strconv.Itoa/Atoi)
+	IntCodec struct{}
+	// VarintCodec stores int64s as binary varints
+	VarintCodec struct{}
+	// JSONCodec stores values as JSON documents
+	JSONCodec[T any] struct{}
+	// GobCodec stores values as self-describing gob streams
+	GobCodec[T any] struct{}
+)
+
+func (StringCodec) Encode(s string) (string, error) { return s, nil }
+func (StringCodec) Decode(s string) (string, error) { return s, nil }
+
+func (IntCodec) Encode(i int) (string, error) { return strconv.Itoa(i), nil }
+func (IntCodec) Decode(s string) (int, error) { return strconv.Atoi(s) }
+
+func (VarintCodec) Encode(i int64) (string, error) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(buf, i)
+	return string(buf[:n]), nil
+}
+
+func (VarintCodec) Decode(s string) (int64, error) {
+	i, n := binary.Varint([]byte(s))
+	if n <= 0 || n != len(s) {
+		return 0, errors.New("invalid varint")
+	}
+	return i, nil
+}
+
+func (JSONCodec[T]) Encode(v T) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (JSONCodec[T]) Decode(s string) (T, error) {
+	var v T
+	err := json.Unmarshal([]byte(s), &v)
+	return v, err
+}
+
+func (GobCodec[T]) Encode(v T) (string, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (GobCodec[T]) Decode(s string) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewBufferString(s)).Decode(&v)
+	return v, err
+}
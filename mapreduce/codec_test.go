@@ -0,0 +1,189 @@
+package mapreduce
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type point struct {
+	X, Y int
+	Tag  string
+}
+
+// Encodes v with c, decodes it back and compares
+func roundTrip[T comparable](t *testing.T, c Codec[T], v T) {
+	t.Helper()
+	s, err := c.Encode(v)
+	if err != nil {
+		t.Fatalf("encoding %v: %v", v, err)
+	}
+	got, err := c.Decode(s)
+	if err != nil {
+		t.Fatalf("decoding %v from %q: %v", v, s, err)
+	}
+	if got != v {
+		t.Errorf("round trip of %v gave %v", v, got)
+	}
+}
+
+func TestCodecRoundTrips(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T)
+	}{
+		{"string", func(t *testing.T) { roundTrip[string](t, StringCodec{}, "emma\x00darcy") }},
+		{"string empty", func(t *testing.T) { roundTrip[string](t, StringCodec{}, "") }},
+		{"int", func(t *testing.T) { roundTrip[int](t, IntCodec{}, 42) }},
+		{"int negative", func(t *testing.T) { roundTrip[int](t, IntCodec{}, -7) }},
+		{"varint zero", func(t *testing.T) { roundTrip[int64](t, VarintCodec{}, 0) }},
+		{"varint max", func(t *testing.T) { roundTrip[int64](t, VarintCodec{}, math.MaxInt64) }},
+		{"varint min", func(t *testing.T) { roundTrip[int64](t, VarintCodec{}, math.MinInt64) }},
+		{"json struct", func(t *testing.T) { roundTrip[point](t, JSONCodec[point]{}, point{X: 1, Y: -2, Tag: "a\"b"}) }},
+		{"json float", func(t *testing.T) { roundTrip[float64](t, JSONCodec[float64]{}, 2.5) }},
+		{"gob struct", func(t *testing.T) { roundTrip[point](t, GobCodec[point]{}, point{X: 3, Y: 4, Tag: "c"}) }},
+		{"gob string", func(t *testing.T) { roundTrip[string](t, GobCodec[string]{}, "lazy dog") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, tt.run)
+	}
+}
+
+func TestCodecDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		decode func(string) error
+		input  string
+	}{
+		{"int text", func(s string) error { _, err := IntCodec{}.Decode(s); return err }, "seven"},
+		{"varint empty", func(s string) error { _, err := VarintCodec{}.Decode(s); return err }, ""},
+		{"varint trailing bytes", func(s string) error { _, err := VarintCodec{}.Decode(s); return err }, "\x02\x02"},
+		{"varint truncated", func(s string) error { _, err := VarintCodec{}.Decode(s); return err }, "\x80"},
+		{"json", func(s string) error { _, err := JSONCodec[point]{}.Decode(s); return err }, "{"},
+		{"gob", func(s string) error { _, err := GobCodec[point]{}.Decode(s); return err }, "not gob"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.decode(tt.input); err == nil {
+				t.Errorf("decoding %q succeeded", tt.input)
+			}
+		})
+	}
+}
+
+// Average word length per first letter: int lengths in the middle, a float average out
+func averageJob() *TypedJob[string, string, string, int, string, float64] {
+	return &TypedJob[string, string, string, int, string, float64]{
+		Mapper: func(_, line string, emit func(string, int) error) error {
+			for _, word := range strings.Fields(line) {
+				if err := emit(word[:1], len(word)); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Reducer: func(letter string, lengths <-chan int, emit func(string, float64) error) error {
+			total, n := 0, 0
+			for l := range lengths {
+				total += l
+				n++
+			}
+			return emit(letter, float64(total)/float64(n))
+		},
+		KeyIn: StringCodec{}, ValueIn: StringCodec{},
+		KeyMid: StringCodec{}, ValueMid: intVarint{},
+		KeyOut: StringCodec{}, ValueOut: JSONCodec[float64]{},
+	}
+}
+
+// VarintCodec for ints, to use a binary intermediate format
+type intVarint struct{}
+
+func (intVarint) Encode(i int) (string, error) { return VarintCodec{}.Encode(int64(i)) }
+func (intVarint) Decode(s string) (int, error) {
+	i, err := VarintCodec{}.Decode(s)
+	return int(i), err
+}
+
+func TestTypedJobIntermediateTypes(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.db")
+	if err := WriteInput(input, []Pair{{Key: "1", Value: "emma ended"}, {Key: "2", Value: "darcy"}, {Key: "3", Value: "dog"}}); err != nil {
+		t.Fatal(err)
+	}
+	result, err := RunLocal(Config{InputPath: input, M: 2, R: 2, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}, averageJob())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Pair{{Key: "d", Value: "4"}, {Key: "e", Value: "4.5"}}
+	if !slices.Equal(result.Output, want) {
+		t.Errorf("got %v, want %v", result.Output, want)
+	}
+}
+
+// Sends values to a typed Reduce like the reduce task does, failing if it stops reading before the end
+func reduceAll(t *testing.T, client Interface, key string, values []string) error {
+	t.Helper()
+	in, out := make(chan string), make(chan Pair, len(values)+1)
+	done := make(chan error, 1)
+	go func() { done <- client.Reduce(key, in, out) }()
+	for _, v := range values {
+		select {
+		case in <- v:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("reduce of %q stopped reading its values", key)
+		}
+	}
+	close(in)
+	return <-done
+}
+
+func TestTypedReduceDrainsOnError(t *testing.T) {
+	values := make([]string, 500)
+	for i := range values {
+		values[i], _ = intVarint{}.Encode(i)
+	}
+	badValues := slices.Clone(values)
+	badValues[10] = "\x80"
+
+	early := averageJob()
+	early.Reducer = func(string, <-chan int, func(string, float64) error) error {
+		return errors.New("gave up")
+	}
+	missing := averageJob()
+	missing.Reducer = nil
+	numbered := &TypedJob[string, string, int, int, int, int]{
+		Reducer: func(int, <-chan int, func(int, int) error) error { return nil },
+		KeyMid:  IntCodec{}, ValueMid: intVarint{}, KeyOut: IntCodec{}, ValueOut: IntCodec{},
+	}
+
+	tests := []struct {
+		name   string
+		client Interface
+		key    string
+		values []string
+		want   string
+	}{
+		{"bad value", averageJob(), "d", badValues, "decoding value"},
+		{"reducer returns early", early, "d", values, "gave up"},
+		{"missing reducer", missing, "d", values, "missing a reducer"},
+		{"bad key", numbered, "d", values, "decoding key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := reduceAll(t, tt.client, tt.key, tt.values)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+	if err := reduceAll(t, averageJob(), "d", values); err != nil {
+		t.Errorf("valid values: %v", err)
+	}
+}
@@ -0,0 +1,306 @@
+package mapreduce
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// A CLI subcommand talking to a running master over RPC
+type command struct {
+	usage            string
+	minArgs, maxArgs int // Number of arguments after the command name
+	run              func(cfg *Config, w io.Writer, args []string) error
+}
+
+var commands = map[string]command{
+	"submit":  {"submit <INPUT_DB> <OUTPUT_DB>", 2, 2, submitCommand},
+	"list":    {"list", 0, 0, listCommand},
+	"status":  {"status [JOB]", 0, 1, statusCommand},
+	"workers": {"workers", 0, 0, workersCommand},
+	"tasks":   {"tasks", 0, 0, tasksCommand},
+	"cancel":  {"cancel [JOB]", 0, 1, cancelCommand},
+	"drain":   {"drain <WORKER>", 1, 1, drainCommand},
+	"logs":    {"logs [STAGE/]<map|reduce>/<N>", 1, 1, logsCommand},
+}
+
+// Runs the subcommand named by args[0] against the master at cfg.MasterAddr
+func runCommand(cfg *Config, w io.Writer, args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	if n := len(args) - 1; n < cmd.minArgs || n > cmd.maxArgs {
+		return fmt.Errorf("usage: PROGRAM [-address MASTER] %s", cmd.usage)
+	}
+	return cmd.run(cfg, w, args[1:])
+}
+
+func submitCommand(cfg *Config, w io.Writer, args []string) error {
+	// The coordinator resolves paths in its own working directory
+	input, err := filepath.Abs(args[0])
+	if err != nil {
+		return fmt.Errorf("input path: %v", err)
+	}
+	output, err := filepath.Abs(args[1])
+	if err != nil {
+		return fmt.Errorf("output path: %v", err)
+	}
+
+	var cacheFiles []string
+	for _, file := range cfg.CacheFiles {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return fmt.Errorf("cache file path: %v", err)
+		}
+		cacheFiles = append(cacheFiles, abs)
+	}
+
+	spec := JobSpec{
+		InputPath:   input,
+		OutputPath:  output,
+		M:           cfg.M,
+		R:           cfg.R,
+		Compression: cfg.Compression,
+		Sorted:      cfg.SortedOutput,
+		Indexed:     cfg.OutputIndex,
+		CacheFiles:  cacheFiles,
+	}
+	var id string
+	if err := cfg.call(cfg.MasterAddr, "NodeActor.Submit", spec, &id); err != nil {
+		return fmt.Errorf("submitting job: %v", err)
+	}
+	fmt.Fprintln(w, id)
+	return nil
+}
+
+func listCommand(cfg *Config, w io.Writer, _ []string) error {
+	var jobs []JobInfo
+	if err := cfg.call(cfg.MasterAddr, "NodeActor.ListJobs", struct{}{}, &jobs); err != nil {
+		return fmt.Errorf("listing jobs: %v", err)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATE\tSUBMITTED\tINPUT\tOUTPUT")
+	for _, job := range jobs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", job.ID, job.State, job.Submitted.Format(time.DateTime), job.Spec.InputPath, job.Spec.OutputPath)
+	}
+	return tw.Flush()
+}
+
+func statusCommand(cfg *Config, w io.Writer, args []string) error {
+	if len(args) == 0 {
+		return currentStatusCommand(cfg, w)
+	}
+
+	var job JobInfo
+	if err := cfg.call(cfg.MasterAddr, "NodeActor.JobStatus", args[0], &job); err != nil {
+		return fmt.Errorf("getting job status: %v", err)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "job\t%s\n", job.ID)
+	fmt.Fprintf(tw, "state\t%s\n", job.State)
+	fmt.Fprintf(tw, "input\t%s\n", job.Spec.InputPath)
+	fmt.Fprintf(tw, "output\t%s\n", job.Spec.OutputPath)
+	fmt.Fprintf(tw, "tasks\tM=%d R=%d\n", job.Spec.M, job.Spec.R)
+	fmt.Fprintf(tw, "submitted\t%s\n", job.Submitted.Format(time.DateTime))
+	if !job.Started.IsZero() {
+		fmt.Fprintf(tw, "started\t%s\n", job.Started.Format(time.DateTime))
+	}
+	if !job.Finished.IsZero() {
+		fmt.Fprintf(tw, "finished\t%s\n", job.Finished.Format(time.DateTime))
+	}
+	if job.Error != "" {
+		fmt.Fprintf(tw, "error\t%s\n", job.Error)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if job.State == JobFailed {
+		return errors.New("job failed")
+	}
+	return nil
+}
+
+// Shows the phase and progress of the job the master is running
+func currentStatusCommand(cfg *Config, w io.Writer) error {
+	status, err := getStatus(cfg)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "job\t%s\n", status.JobID)
+	if status.Stage != "" {
+		fmt.Fprintf(tw, "stage\t%s\n", status.Stage)
+	}
+	fmt.Fprintf(tw, "phase\t%s\n", status.Phase)
+	fmt.Fprintf(tw, "progress\t%.1f%%\n", status.Progress*100)
+	fmt.Fprintf(tw, "elapsed\t%s\n", seconds(status.Elapsed))
+	if status.ETA >= 0 {
+		fmt.Fprintf(tw, "eta\t%s\n", seconds(status.ETA))
+	}
+	fmt.Fprintf(tw, "map tasks\t%d/%d completed\n", countState(status.MapTasks, Completed), len(status.MapTasks))
+	fmt.Fprintf(tw, "reduce tasks\t%d/%d completed\n", countState(status.ReduceTasks, Completed), len(status.ReduceTasks))
+	fmt.Fprintf(tw, "workers\t%d\n", len(status.Workers))
+	return tw.Flush()
+}
+
+func workersCommand(cfg *Config, w io.Writer, _ []string) error {
+	var workers []WorkerStatus
+	if err := cfg.call(cfg.MasterAddr, "NodeActor.Workers", struct{}{}, &workers); err != nil {
+		return fmt.Errorf("listing workers: %v", err)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "WORKER\tSTATE\tLAST SEEN\tTASKS")
+	for _, worker := range workers {
+		state := "active"
+		if worker.Draining {
+			state = "draining"
+		}
+		tasks := "-"
+		if len(worker.Tasks) > 0 {
+			tasks = strings.Join(worker.Tasks, ", ")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s ago\t%s\n", worker.Addr, state, seconds(worker.Idle), tasks)
+	}
+	return tw.Flush()
+}
+
+func tasksCommand(cfg *Config, w io.Writer, _ []string) error {
+	status, err := getStatus(cfg)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TASK\tSTATE\tWORKER\tATTEMPTS\tPROGRESS\tDURATION")
+	for _, phase := range []Phase{Map, Reduce} {
+		tasks := status.MapTasks
+		if phase == Reduce {
+			tasks = status.ReduceTasks
+		}
+		for _, task := range tasks {
+			state, worker, progress, duration := task.State, task.Worker, "-", "-"
+			if task.Stuck {
+				state += " (stuck)"
+			}
+			if worker == "" {
+				worker = "-"
+			}
+			if task.Backup != "" {
+				worker += ", backup " + task.Backup
+			}
+			if task.Progress >= 0 {
+				progress = fmt.Sprintf("%.1f%%", task.Progress*100)
+			}
+			if task.Worker != "" {
+				duration = seconds(task.Duration)
+			}
+			fmt.Fprintf(tw, "%s/%d\t%s\t%s\t%d\t%s\t%s\n", phase, task.Number, state, worker, task.Attempts, progress, duration)
+		}
+	}
+	return tw.Flush()
+}
+
+func cancelCommand(cfg *Config, _ io.Writer, args []string) error {
+	var id string
+	if len(args) > 0 {
+		id = args[0]
+	} else {
+		// The job the master is running
+		status, err := getStatus(cfg)
+		if err != nil {
+			return err
+		}
+		id = status.JobID
+	}
+	if err := cfg.call(cfg.MasterAddr, "NodeActor.Cancel", id, nil); err != nil {
+		return fmt.Errorf("canceling job: %v", err)
+	}
+	return nil
+}
+
+func drainCommand(cfg *Config, _ io.Writer, args []string) error {
+	if err := cfg.call(cfg.MasterAddr, "NodeActor.Drain", args[0], nil); err != nil {
+		return fmt.Errorf("draining worker: %v", err)
+	}
+	return nil
+}
+
+func logsCommand(cfg *Config, w io.Writer, args []string) error {
+	ref, err := parseTaskRef(args[0])
+	if err != nil {
+		return err
+	}
+	var log TaskLog
+	if err := cfg.call(cfg.MasterAddr, "NodeActor.TaskLogs", ref, &log); err != nil {
+		return fmt.Errorf("getting task logs: %v", err)
+	}
+
+	for _, e := range log.Events {
+		fmt.Fprintf(w, "%s %s attempt=%d worker=%s", e.Time.Format(time.RFC3339Nano), e.Type, e.Attempt, e.Worker)
+		if e.Detail != "" {
+			fmt.Fprintf(w, " detail=%q", e.Detail)
+		}
+		fmt.Fprintln(w)
+	}
+	for _, line := range log.Lines {
+		fmt.Fprintln(w, line)
+	}
+	return nil
+}
+
+// Parses a task like map/3 or reduce/0, optionally prefixed with a pipeline stage like count/reduce/0
+func parseTaskRef(s string) (TaskRef, error) {
+	invalid := fmt.Errorf("invalid task %q, expected [STAGE/]map/<N> or [STAGE/]reduce/<N>", s)
+	var ref TaskRef
+	rest := s
+	if strings.Count(s, "/") == 2 {
+		ref.Stage, rest, _ = strings.Cut(s, "/")
+	}
+	phase, number, ok := strings.Cut(rest, "/")
+	n, err := strconv.Atoi(number)
+	if !ok || err != nil || n < 0 {
+		return TaskRef{}, invalid
+	}
+	ref.Number = n
+	switch phase {
+	case Map.String():
+		ref.Phase = Map
+	case Reduce.String():
+		ref.Phase = Reduce
+	default:
+		return TaskRef{}, invalid
+	}
+	return ref, nil
+}
+
+func getStatus(cfg *Config) (Status, error) {
+	var status Status
+	if err := cfg.call(cfg.MasterAddr, "NodeActor.Status", struct{}{}, &status); err != nil {
+		return status, fmt.Errorf("getting status: %v", err)
+	}
+	return status, nil
+}
+
+func countState(tasks []TaskStatus, state TaskState) int {
+	count := 0
+	for _, task := range tasks {
+		if task.State == state.String() {
+			count++
+		}
+	}
+	return count
+}
+
+func seconds(s float64) string {
+	return time.Duration(s * float64(time.Second)).Round(time.Second / 10).String()
+}
@@ -0,0 +1,127 @@
+package mapreduce
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Compression codecs for intermediate and output files
+const (
+	NoCompression   = "none"
+	GzipCompression = "gzip"
+
+	gzipExt = ".gz"
+)
+
+func validCompression(codec string) bool {
+	return codec == "" || codec == NoCompression || codec == GzipCompression
+}
+
+// Compresses the file at path in place using codec (path becomes path.gz). Returns the number of bytes saved.
+func compressFile(path, codec string) (int64, error) {
+	if codec != GzipCompression {
+		return 0, nil
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("opening file: %v", err)
+	}
+	defer in.Close()
+
+	// Written under a temporary name, since a path.gz is served in place of path as soon as it exists
+	temp := path + gzipExt + ".tmp"
+	out, err := os.Create(temp)
+	if err != nil {
+		return 0, fmt.Errorf("creating compressed file: %v", err)
+	}
+	defer os.Remove(temp)
+	defer out.Close()
+
+	zw := gzip.NewWriter(out)
+	rawSize, err := io.Copy(zw, in)
+	if err != nil {
+		return 0, fmt.Errorf("compressing data: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return 0, fmt.Errorf("flushing compressed data: %v", err)
+	}
+	info, err := out.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("stat compressed file: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		return 0, fmt.Errorf("closing compressed file: %v", err)
+	}
+	if err := os.Rename(temp, path+gzipExt); err != nil {
+		return 0, fmt.Errorf("renaming compressed file: %v", err)
+	}
+
+	// Only the compressed copy is served from now on
+	in.Close()
+	if err := os.Remove(path); err != nil {
+		return 0, fmt.Errorf("removing uncompressed file: %v", err)
+	}
+
+	return rawSize - info.Size(), nil
+}
+
+// Serves files from dir. Files stored compressed (name.gz) are served under their plain name,
+// as-is to clients accepting gzip and decompressed on the fly to everyone else. A corrupt compressed file
+// aborts the response, since the status was sent already.
+func dataHandler(logger *slog.Logger, dir string) http.Handler {
+	files := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+		if _, err := os.Stat(name); err == nil {
+			files.ServeHTTP(w, r)
+			return
+		}
+
+		f, err := os.Open(name + gzipExt)
+		if err != nil {
+			files.ServeHTTP(w, r)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if acceptsGzip(r) {
+			w.Header().Set("Content-Encoding", "gzip")
+			http.ServeContent(w, r, name, info.ModTime(), f)
+			return
+		}
+
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if _, err := io.Copy(w, zr); err != nil {
+			logger.Error("serving compressed file", "file", name+gzipExt, "err", err)
+			panic(http.ErrAbortHandler)
+		}
+	})
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.SplitN(enc, ";", 2)[0]) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
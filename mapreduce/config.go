@@ -0,0 +1,122 @@
+package mapreduce
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type (
+	// Config holds the settings of a node
+	Config struct {
+		Master     bool   // Whether this node is the master or a worker
+		Wait       bool   // Whether workers wait for a master signal (keypress) or start immediately upon joining
+		Serve      bool   // Whether the master runs submitted jobs until killed instead of a single job
+		MasterAddr string // Address of the master node
+		Host       string // Address this node listens on
+		Tempdir    string // Directory to store temporary files in
+		M, R       int    // Number of map and reduce tasks
+		InputPath  string // Input db (master only)
+		OutputPath string // Output db (master only)
+		JobID      string // Identifies the job in logs, generated by the master if empty
+		Workers    int    // Goroutine workers used by RunLocal, defaults to GOMAXPROCS
+
+		StuckTimeout time.Duration // Running tasks whose progress doesn't move for this long get a backup attempt
+
+		Compression  string // Codec for intermediate and output files
+		SortedOutput bool   // Write the output sorted by key, then value, so identical jobs produce identical files
+		OutputIndex  bool   // Index the output on key
+		Token        string // Shared secret required on every request (empty disables authentication)
+		TLSCert      string // Certificate file (enables TLS)
+		TLSKey       string // Private key file for TLSCert
+		TLSCA        string // CA bundle used to verify peers (enables mTLS)
+		Trace        bool   // Record spans and write them as a Chrome trace next to the output (master only)
+
+		CacheFiles []string // Files served to every task of the job, see TaskContext.CacheFile (master only)
+
+		Logger *slog.Logger // Defaults to text (logfmt) logs on stderr at info level
+
+		// Hooks for embedding nodes, e.g. several in one process for tests
+		Listener  net.Listener                                 // Serves on this instead of listening on Host
+		Dial      func(network, addr string) (net.Conn, error) // Connects to other nodes for RPC calls, net.Dial if nil
+		Transport http.RoundTripper                            // Used for data transfers instead of the one built from the TLS settings
+
+		mux        *http.ServeMux // Routes of the node's HTTP server
+		serverTLS  *tls.Config    // Built from the TLS files
+		clientTLS  *tls.Config    // Built from the TLS files
+		httpClient *http.Client   // Used for all data transfers
+		spans      *tracer        // Spans of the current job or task, nil when not tracing
+		progress   *taskProgress  // Rows processed by the current task (workers only)
+		cache      *fileCache     // Cache files downloaded by this node, shared by its copies
+	}
+)
+
+// DefaultConfig returns the settings used when no flags are given
+func DefaultConfig() Config {
+	return Config{
+		MasterAddr:   "localhost:8080",
+		Host:         "localhost:8080",
+		Tempdir:      filepath.Join("tmp", fmt.Sprintf("mapreduce.%d", os.Getpid())),
+		M:            10,
+		R:            10,
+		StuckTimeout: 30 * time.Second,
+		Compression:  NoCompression,
+		Token:        os.Getenv(tokenEnv),
+	}
+}
+
+// Validates the settings and fills in derived ones
+func (cfg *Config) setup() error {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+	}
+	if !validCompression(cfg.Compression) {
+		return fmt.Errorf("unknown compression codec %q", cfg.Compression)
+	}
+	if err := cfg.setupSecurity(); err != nil {
+		return fmt.Errorf("tls: %v", err)
+	}
+	if cfg.Transport != nil {
+		cfg.httpClient = &http.Client{Transport: cfg.Transport}
+	}
+	cfg.mux = http.NewServeMux()
+	cfg.cache = newFileCache()
+	if cfg.Master && cfg.JobID == "" {
+		cfg.JobID = fmt.Sprintf("%s-%d", time.Now().Format("20060102-150405"), os.Getpid())
+	}
+	return nil
+}
+
+// Returns a copy of the config that logs with the given attributes added
+func (cfg *Config) with(args ...any) *Config {
+	child := *cfg
+	child.Logger = cfg.Logger.With(args...)
+	return &child
+}
+
+// Builds a logger writing to w. Level is one of debug|info|warn|error and format is text (logfmt) or json.
+func NewLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("log level: %v", err)
+	}
+	opts := &slog.HandlerOptions{
+		Level:     lvl,
+		AddSource: lvl <= slog.LevelDebug,
+	}
+
+	switch strings.ToLower(format) {
+	case "text", "logfmt":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
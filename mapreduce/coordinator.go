@@ -0,0 +1,207 @@
+package mapreduce
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Job states
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCanceled  = "canceled"
+)
+
+type (
+	// JobSpec describes a job submitted to a coordinator. Paths are on the coordinator's file system.
+	JobSpec struct {
+		InputPath   string
+		OutputPath  string
+		M, R        int      // R only applies to single-stage jobs, pipeline stages set their own
+		Compression string   // Defaults to the coordinator's
+		Sorted      bool     // Sort the output, also turned on by the coordinator's -sorted-output
+		Indexed     bool     // Index the output on key, also turned on by the coordinator's -output-index
+		CacheFiles  []string // Served to the tasks along with the coordinator's -cache-file files
+	}
+
+	// JobInfo tracks a job submitted to a coordinator
+	JobInfo struct {
+		ID        string
+		Spec      JobSpec
+		State     string
+		Error     string `json:",omitempty"`
+		Submitted time.Time
+		Started   time.Time `json:",omitempty"`
+		Finished  time.Time `json:",omitempty"`
+	}
+)
+
+// Runs submitted jobs one after another, until the process exits
+func (a NodeActor) serveJobs(cfg *Config, stages []Stage) {
+	for {
+		var job *JobInfo
+		var queued <-chan struct{}
+		a.run(func(n *Node) {
+			queued = n.queued
+			for _, j := range n.Jobs {
+				if j.State == JobQueued {
+					job = j
+					job.State = JobRunning
+					job.Started = time.Now()
+					return
+				}
+			}
+		})
+		if job == nil {
+			<-queued
+			continue
+		}
+
+		jcfg := *cfg
+		jcfg.JobID = job.ID
+		jcfg.InputPath, jcfg.OutputPath = job.Spec.InputPath, job.Spec.OutputPath
+		jcfg.M, jcfg.R = job.Spec.M, job.Spec.R
+		jcfg.Compression = job.Spec.Compression
+		jcfg.SortedOutput = cfg.SortedOutput || job.Spec.Sorted
+		jcfg.OutputIndex = cfg.OutputIndex || job.Spec.Indexed
+		jcfg.CacheFiles = append(append([]string(nil), cfg.CacheFiles...), job.Spec.CacheFiles...)
+		logger := jcfg.with("job", job.ID).Logger
+
+		// The R of a submitted job is for single-stage jobs, pipeline stages set their own
+		jobStages := stages
+		if len(stages) == 1 {
+			jobStages = []Stage{stages[0]}
+			jobStages[0].R = job.Spec.R
+		}
+
+		logger.Info("starting job", "input", job.Spec.InputPath, "output", job.Spec.OutputPath, "M", job.Spec.M, "R", job.Spec.R)
+		err := a.runJob(jcfg.with("job", job.ID), jobStages)
+		a.run(func(n *Node) {
+			job.Finished = time.Now()
+			switch {
+			case errors.Is(err, errCanceled):
+				job.State = JobCanceled
+			case err != nil:
+				job.State, job.Error = JobFailed, err.Error()
+			default:
+				job.State = JobSucceeded
+			}
+			if n.Phase != Finish {
+				n.setPhase(Finish)
+			}
+		})
+		if err != nil {
+			logger.Error("job failed", "err", err)
+		} else {
+			logger.Info("job finished", "duration", job.Finished.Sub(job.Started))
+		}
+	}
+}
+
+// Queues a job on a coordinator and returns its ID
+func (a NodeActor) Submit(spec JobSpec, id *string) error {
+	var err error
+	a.run(func(n *Node) {
+		if !n.cfg.Serve {
+			err = errors.New("master is not accepting jobs (start it with -serve)")
+			return
+		}
+		if spec.Compression == "" {
+			spec.Compression = n.cfg.Compression
+		}
+		switch {
+		case spec.InputPath == "" || spec.OutputPath == "":
+			err = errors.New("input and output paths are required")
+			return
+		case spec.M <= 0 || spec.R < 0:
+			err = fmt.Errorf("M must be positive and R not negative (M=%d, R=%d)", spec.M, spec.R)
+			return
+		case !validCompression(spec.Compression):
+			err = fmt.Errorf("unknown compression codec %q", spec.Compression)
+			return
+		}
+
+		job := &JobInfo{
+			ID:        fmt.Sprintf("%s-%d", time.Now().Format("20060102-150405"), len(n.Jobs)+1),
+			Spec:      spec,
+			State:     JobQueued,
+			Submitted: time.Now(),
+		}
+		n.Jobs = append(n.Jobs, job)
+		*id = job.ID
+		n.cfg.Logger.Info("job submitted", "submitted_job", job.ID, "input", spec.InputPath, "output", spec.OutputPath)
+
+		// Wake up the coordinator if it is idle
+		select {
+		case n.queued <- struct{}{}:
+		default:
+		}
+	})
+	return err
+}
+
+// Lists the jobs submitted to a coordinator, oldest first
+func (a NodeActor) ListJobs(_ struct{}, jobs *[]JobInfo) error {
+	a.run(func(n *Node) {
+		*jobs = make([]JobInfo, len(n.Jobs))
+		for i, job := range n.Jobs {
+			(*jobs)[i] = *job
+		}
+	})
+	return nil
+}
+
+// Looks up a job submitted to a coordinator
+func (a NodeActor) JobStatus(id string, job *JobInfo) error {
+	var err error
+	a.run(func(n *Node) {
+		j := n.findJob(id)
+		if j == nil {
+			err = fmt.Errorf("no job %q", id)
+			return
+		}
+		*job = *j
+	})
+	return err
+}
+
+// Cancels a queued or running job. Tasks already running finish, but their results are ignored.
+func (a NodeActor) Cancel(id string, _ *struct{}) error {
+	var err error
+	a.run(func(n *Node) {
+		if id == n.JobID && n.Phase >= Map && n.Phase <= ReduceDone {
+			n.cfg.Logger.Warn("canceling job")
+			n.canceled = true
+			n.setPhase(Wait)
+			n.wakeUp()
+			return
+		}
+
+		j := n.findJob(id)
+		switch {
+		case id == n.JobID || j != nil && j.State == JobRunning:
+			err = fmt.Errorf("job %q can only be canceled in the map and reduce phases", id)
+		case j == nil:
+			err = fmt.Errorf("no job %q", id)
+		case j.State != JobQueued:
+			err = fmt.Errorf("job %q is already %s", id, j.State)
+		default:
+			j.State = JobCanceled
+			j.Finished = time.Now()
+			n.cfg.Logger.Info("queued job canceled", "canceled_job", id)
+		}
+	})
+	return err
+}
+
+func (n *Node) findJob(id string) *JobInfo {
+	for _, job := range n.Jobs {
+		if job.ID == id {
+			return job
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package mapreduce
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+)
+
+type (
+	// ContextMapper can be implemented by clients that want a TaskContext in their map function.
+	// When implemented it is called instead of Interface.Map.
+	ContextMapper interface {
+		MapWithContext(ctx *TaskContext, key, value string, output chan<- Pair) error
+	}
+
+	// ContextReducer can be implemented by clients that want a TaskContext in their reduce function.
+	// When implemented it is called instead of Interface.Reduce.
+	ContextReducer interface {
+		ReduceWithContext(ctx *TaskContext, key string, values <-chan string, output chan<- Pair) error
+	}
+
+	// TaskContext carries per task facilities for client code
+	TaskContext struct {
+		Phase  Phase
+		Number int // Task number
+		State  any // Free for the client, e.g. to combine in memory from the first Map call to the cleanup
+
+		mu       sync.Mutex
+		counters Counters
+		sides    *sideOutputs // Named outputs of the task, nil outside of tasks
+		cache    *taskCache   // Cache files of the job, nil outside of tasks
+	}
+
+	// Counters maps user counter names to values
+	Counters map[string]int64
+)
+
+func newTaskContext(phase Phase, number int) *TaskContext {
+	return &TaskContext{
+		Phase:    phase,
+		Number:   number,
+		counters: make(Counters),
+	}
+}
+
+// Count adds delta to the named counter. Counters are summed over all tasks of the job.
+func (ctx *TaskContext) Count(name string, delta int64) {
+	ctx.mu.Lock()
+	ctx.counters[name] += delta
+	ctx.mu.Unlock()
+}
+
+// Returns a copy of the task's counters
+func (ctx *TaskContext) snapshot() Counters {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	counters := make(Counters, len(ctx.counters))
+	for name, value := range ctx.counters {
+		counters[name] = value
+	}
+	return counters
+}
+
+// Calls the client's map function, with a context if the client accepts one. A panic is returned as an error.
+func callMap(ctx *TaskContext, client Interface, key, value string, output chan<- Pair) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("map panicked on key %q: %v", key, r)
+		}
+	}()
+	if mapper, ok := client.(ContextMapper); ok {
+		return mapper.MapWithContext(ctx, key, value, output)
+	}
+	return client.Map(key, value, output)
+}
+
+// Calls the client's reduce function, with a context if the client accepts one. A panic is returned as an error.
+func callReduce(ctx *TaskContext, client Interface, key string, values <-chan string, output chan<- Pair) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("reduce panicked on key %q: %v", key, r)
+		}
+	}()
+	if reducer, ok := client.(ContextReducer); ok {
+		return reducer.ReduceWithContext(ctx, key, values, output)
+	}
+	return client.Reduce(key, values, output)
+}
+
+// Adds all values of other
+func (c Counters) merge(other Counters) {
+	for name, value := range other {
+		c[name] += value
+	}
+}
+
+// Logs the counters in name order
+func (c Counters) log(logger *slog.Logger) {
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		logger.Info("counter", "name", name, "value", c[name])
+	}
+}
+
+// Writes the counters as a JSON object to path
+func (c Counters) save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding counters: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("writing counters: %v", err)
+	}
+	return nil
+}
@@ -4,9 +4,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"io"
-	"log"
-	"net/http"
+	"log/slog"
 	"os"
 	"path/filepath"
 
@@ -53,9 +51,83 @@ func createDatabase(path string) (*sql.DB, error) {
 	return db, nil
 }
 
+// WriteInput creates an input db at path holding pairs
+func WriteInput(path string, pairs []Pair) error {
+	db, err := createDatabase(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("starting transaction: %v", err)
+	}
+	stmt, err := tx.Prepare("INSERT INTO pairs (key, value) values (?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("preparing insert statement: %v", err)
+	}
+	defer stmt.Close()
+	for _, pair := range pairs {
+		if _, err := stmt.Exec(pair.Key, pair.Value); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("inserting into input db: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing input db: %v", err)
+	}
+	return nil
+}
+
+// ReadOutput returns the pairs of an output db, sorted by key and then value
+func ReadOutput(path string) ([]Pair, error) {
+	return readTable(path, "pairs")
+}
+
+// Returns the pairs of a table, sorted by key and then value
+func readTable(path, table string) ([]Pair, error) {
+	db, err := openDatabase(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(fmt.Sprintf("SELECT key, value FROM %s ORDER BY key, value", table))
+	if err != nil {
+		return nil, fmt.Errorf("querying output db: %v", err)
+	}
+	defer rows.Close()
+	var pairs []Pair
+	for rows.Next() {
+		var pair Pair
+		if err := rows.Scan(&pair.Key, &pair.Value); err != nil {
+			return nil, fmt.Errorf("reading a row from output db: %v", err)
+		}
+		pairs = append(pairs, pair)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating over output db: %v", err)
+	}
+	return pairs, nil
+}
+
+// Returns the number of pairs in a database
+func countPairs(db *sql.DB) (int64, error) {
+	var count int64
+	if err := db.QueryRow("SELECT COUNT(*) FROM pairs").Scan(&count); err != nil {
+		return 0, fmt.Errorf("counting pairs: %v", err)
+	}
+	return count, nil
+}
+
 // Splits a database into multiple (contiguous) shards. Returns filenames of output databases.
 // e.g. paths, err := splitDatabase("input.db", "data", "output-%d.db", 50)
-func splitDatabase(source, outputDir, outputPattern string, m int) ([]string, error) {
+func splitDatabase(logger *slog.Logger, source, outputDir, outputPattern string, m int) ([]string, error) {
+	if m <= 0 {
+		return nil, fmt.Errorf("can't split into %d parts, M must be positive", m)
+	}
 	// Open source database
 	db, err := openDatabase(source)
 	if err != nil {
@@ -70,7 +142,7 @@ func splitDatabase(source, outputDir, outputPattern string, m int) ([]string, er
 	if err := db.QueryRow("SELECT COUNT(*) AS count FROM pairs").Scan(&total); err != nil || err == sql.ErrNoRows {
 		return nil, fmt.Errorf("unable to get total size of data from source db: %v", err)
 	}
-	log.Printf("Size of data: %d", total)
+	logger.Info("splitting input", "source", source, "pairs", total)
 
 	// Fewer keys than map tasks
 	if total < m {
@@ -123,7 +195,7 @@ func splitDatabase(source, outputDir, outputPattern string, m int) ([]string, er
 		stmt.Close()
 		db.Close()
 
-		log.Printf("%s => size: %d; total: %d\n", name, partitionSize, count)
+		logger.Debug("wrote shard", "file", name, "pairs", partitionSize, "total", count)
 	}
 
 	// Check for errors from iterating over rows.
@@ -140,18 +212,26 @@ func splitDatabase(source, outputDir, outputPattern string, m int) ([]string, er
 	return outPaths, nil
 }
 
-// Merge databases located trough urls into a destination local db, using temp as the temporary write file
-func mergeDatabases(urls []string, dest string, temp string) (*sql.DB, error) {
+// Merge databases located trough urls into a destination local db, using temp as the temporary write file.
+// Each download is verified against the matching entry of sums (if sums is nil nothing is verified).
+func (cfg *Config) mergeDatabases(urls []string, sums []FileSum, dest string, temp string) (*sql.DB, error) {
 	db, err := createDatabase(dest)
 	if err != nil {
 		return nil, fmt.Errorf("creating database: %v", err)
 	}
 
-	for _, url := range urls {
+	for i, url := range urls {
+		var sum FileSum
+		if sums != nil {
+			sum = sums[i]
+		}
 		// Download and store in temp dir
-		if err := download(url, temp); err != nil {
+		endFetch := cfg.spans.start("fetch", "url", url)
+		err := cfg.downloadVerified(url, temp, sum)
+		endFetch()
+		if err != nil {
 			db.Close()
-			return nil, fmt.Errorf("downloading db %s: %v", url, err)
+			return nil, fmt.Errorf("downloading db %s: %w", url, err)
 		}
 		// Merge and delete temp
 		if err := gatherInto(db, temp); err != nil {
@@ -163,26 +243,55 @@ func mergeDatabases(urls []string, dest string, temp string) (*sql.DB, error) {
 	return db, nil
 }
 
-// Download a file over HTTP and store in dest path
-func download(url, dest string) error {
-	resp, err := http.Get(url)
+// Merges the reduce outputs into the output db at dest, using dir for temporary files. With cfg.SortedOutput the
+// rows are written in canonical order (by key, then value), so identical jobs produce identical files.
+func (cfg *Config) mergeOutput(urls []string, sums []FileSum, dest string, dir string) error {
+	merged := dest
+	if cfg.SortedOutput {
+		merged = filepath.Join(dir, "unsorted.db")
+	}
+	db, err := cfg.mergeDatabases(urls, sums, merged, filepath.Join(dir, "tmp.db"))
 	if err != nil {
-		return fmt.Errorf("http get: %v", err)
+		return err
 	}
-	defer resp.Body.Close()
+	db.Close()
 
-	// Create the file
-	out, err := os.Create(dest)
-	if err != nil {
-		return fmt.Errorf("creating destination file: %v", err)
+	if cfg.SortedOutput {
+		if err := sortDatabase(merged, dest); err != nil {
+			return fmt.Errorf("sorting output: %v", err)
+		}
+		if err := os.Remove(merged); err != nil {
+			return fmt.Errorf("removing unsorted output: %v", err)
+		}
 	}
-	defer out.Close()
 
-	// Write the body to file
-	if _, err := io.Copy(out, resp.Body); err != nil {
-		return fmt.Errorf("copying data: %v", err)
+	if cfg.OutputIndex {
+		db, err := openDatabase(dest)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		if _, err := db.Exec("CREATE INDEX pairs_key ON pairs (key)"); err != nil {
+			return fmt.Errorf("indexing output: %v", err)
+		}
 	}
+	return nil
+}
+
+const sortCmd = `ATTACH ? AS unsorted;
+INSERT INTO pairs SELECT key, value FROM unsorted.pairs ORDER BY key, value;
+DETACH unsorted;`
 
+// Copies the pairs of db at <in> into a new db at <out>, sorted by key and then value
+func sortDatabase(in, out string) error {
+	db, err := createDatabase(out)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if _, err := db.Exec(sortCmd, in); err != nil {
+		return fmt.Errorf("copying sorted pairs: %v", err)
+	}
 	return nil
 }
 
@@ -0,0 +1,422 @@
+package mapreduce
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitAndMerge(t *testing.T) {
+	dir := t.TempDir()
+	var pairs []Pair
+	for i := 0; i < 100; i++ {
+		pairs = append(pairs, Pair{Key: fmt.Sprintf("key%03d", i), Value: strconv.Itoa(i)})
+	}
+	input := filepath.Join(dir, "input.db")
+	if err := WriteInput(input, pairs); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	names, err := splitDatabase(logger, input, dir, "output-%d.db", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 7 {
+		t.Fatalf("split into %d files, want 7", len(names))
+	}
+
+	cfg := &Config{Host: localHost, Logger: logger}
+	cfg.httpClient = &http.Client{Transport: handlerTransport{http.StripPrefix("/data", dataHandler(logger, dir))}}
+	urls := make([]string, len(names))
+	for i, name := range names {
+		urls[i] = cfg.makeURL(cfg.Host, name)
+	}
+	merged := filepath.Join(dir, "merged.db")
+	db, err := cfg.mergeDatabases(urls, nil, merged, filepath.Join(dir, "temp.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	got, err := ReadOutput(merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, pairs) {
+		t.Errorf("merged %d pairs that differ from the %d split ones", len(got), len(pairs))
+	}
+}
+
+type wordCount struct{}
+
+func (wordCount) Map(key, value string, output chan<- Pair) error {
+	defer close(output)
+	for _, word := range strings.Fields(value) {
+		output <- Pair{Key: word, Value: "1"}
+	}
+	return nil
+}
+
+func (wordCount) Reduce(key string, values <-chan string, output chan<- Pair) error {
+	defer close(output)
+	count := 0
+	for range values {
+		count++
+	}
+	output <- Pair{Key: key, Value: strconv.Itoa(count)}
+	return nil
+}
+
+func TestRunLocal(t *testing.T) {
+	dir := t.TempDir()
+	lines := []string{"a b c", "b c", "c", "d a", ""}
+	var pairs []Pair
+	want := make(map[string]int)
+	for i := 0; i < 50; i++ {
+		line := lines[i%len(lines)]
+		pairs = append(pairs, Pair{Key: strconv.Itoa(i), Value: line})
+		for _, word := range strings.Fields(line) {
+			want[word]++
+		}
+	}
+	input := filepath.Join(dir, "input.db")
+	if err := WriteInput(input, pairs); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, compression := range []string{NoCompression, GzipCompression} {
+		result, err := RunLocal(Config{
+			Tempdir:     filepath.Join(dir, compression),
+			InputPath:   input,
+			M:           9,
+			R:           3,
+			Compression: compression,
+			Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+		}, wordCount{})
+		if err != nil {
+			t.Fatalf("%s: %v", compression, err)
+		}
+		if len(result.Output) != len(want) {
+			t.Errorf("%s: got %d words, want %d", compression, len(result.Output), len(want))
+		}
+		for _, pair := range result.Output {
+			if pair.Value != strconv.Itoa(want[pair.Key]) {
+				t.Errorf("%s: %s counted %s times, want %d", compression, pair.Key, pair.Value, want[pair.Key])
+			}
+		}
+	}
+}
+
+// Counts lines by their first word, so blank lines count under the empty key
+type firstWord struct{ wordCount }
+
+func (firstWord) Map(key, value string, output chan<- Pair) error {
+	defer close(output)
+	word, _, _ := strings.Cut(value, " ")
+	output <- Pair{Key: word, Value: "1"}
+	return nil
+}
+
+func TestRunLocalRejectsZeroM(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "input.db")
+	if err := WriteInput(input, []Pair{{Key: "1", Value: "a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RunLocal(Config{InputPath: input, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}, wordCount{}); err == nil || !strings.Contains(err.Error(), "M must be positive") {
+		t.Errorf("got error %v, want one about M", err)
+	}
+	if _, err := splitDatabase(slog.New(slog.NewTextHandler(io.Discard, nil)), input, t.TempDir(), "part_%d.db", 0); err == nil {
+		t.Error("splitting into 0 parts succeeded")
+	}
+}
+
+func TestRunLocalEmptyKey(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.db")
+	if err := WriteInput(input, []Pair{{Key: "1", Value: ""}, {Key: "2", Value: "a b"}, {Key: "3", Value: ""}, {Key: "4", Value: "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan []Pair, 1)
+	go func() {
+		result, err := RunLocal(Config{InputPath: input, M: 2, R: 1, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}, firstWord{})
+		if err != nil {
+			t.Error(err)
+			done <- nil
+			return
+		}
+		done <- result.Output
+	}()
+	select {
+	case got := <-done:
+		want := []Pair{{Key: "", Value: "2"}, {Key: "a", Value: "1"}, {Key: "b", Value: "1"}}
+		if !slices.Equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("job with an empty key did not finish")
+	}
+}
+
+// Fails in a cleanup method of a phase without closing its output
+type failingCleanup struct {
+	wordCount
+	phase Phase
+}
+
+func (c failingCleanup) MapCleanup(ctx *TaskContext, output chan<- Pair) error {
+	if c.phase == Map {
+		return errors.New("cleanup failed")
+	}
+	close(output)
+	return nil
+}
+
+func (c failingCleanup) ReduceCleanup(ctx *TaskContext, output chan<- Pair) error {
+	if c.phase == Reduce {
+		panic("cleanup failed")
+	}
+	close(output)
+	return nil
+}
+
+// Fails on the first value of a key, leaving the rest unread and its output open
+type failingReduce struct{ wordCount }
+
+func (failingReduce) Reduce(key string, values <-chan string, output chan<- Pair) error {
+	<-values
+	return errors.New("reduce failed")
+}
+
+// Hooks that panic on their first call
+type (
+	panickingSort      struct{ wordCount }
+	panickingGroup     struct{ wordCount }
+	panickingPartition struct{ wordCount }
+)
+
+func (panickingSort) SortCompare(a, b Pair) int            { panic("sort failed") }
+func (panickingGroup) GroupCompare(a, b string) int        { panic("group failed") }
+func (panickingPartition) Partition(key string, r int) int { panic("partition failed") }
+
+// Fails the test if goroutines running any of funcs are left once tasks ended
+func checkGoroutinesEnded(t *testing.T, funcs ...string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stacks := make([]byte, 1<<20)
+		stacks = stacks[:runtime.Stack(stacks, true)]
+		left := false
+		for _, f := range funcs {
+			left = left || bytes.Contains(stacks, []byte(f+"("))
+		}
+		if !left {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("task goroutines still running after the tasks ended:\n%s", stacks)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFailedCallsStopTaskGoroutines(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.db")
+	var pairs []Pair
+	for i := 0; i < 1000; i++ {
+		pairs = append(pairs, Pair{Key: strconv.Itoa(i), Value: "a b"})
+	}
+	if err := WriteInput(input, pairs); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		client Interface
+		want   string
+	}{
+		{"map cleanup", failingCleanup{phase: Map}, "cleanup failed"},
+		{"reduce cleanup", failingCleanup{phase: Reduce}, "cleanup failed"},
+		{"reduce", failingReduce{}, "reduce failed"},
+		{"sort comparator", panickingSort{}, "sort comparator panicked: sort failed"},
+		{"group comparator", panickingGroup{}, "group comparator panicked"},
+		{"partitioner", panickingPartition{}, "partition panicked"},
+	}
+	for _, tt := range tests {
+		_, err := RunLocal(Config{InputPath: input, M: 2, R: 2, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}, tt.client)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want one containing %q", tt.name, err, tt.want)
+		}
+	}
+	checkGoroutinesEnded(t, ").writeOutput", ".readInput")
+}
+
+// Counts keys without reading their values
+type keyCount struct{ wordCount }
+
+func (keyCount) Reduce(key string, values <-chan string, output chan<- Pair) error {
+	defer close(output)
+	output <- Pair{Key: key, Value: "1"}
+	return nil
+}
+
+func TestReduceInputReaderEnds(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.db")
+	var pairs []Pair
+	for i := 0; i < 1000; i++ {
+		pairs = append(pairs, Pair{Key: strconv.Itoa(i), Value: "a b"})
+	}
+	if err := WriteInput(input, pairs); err != nil {
+		t.Fatal(err)
+	}
+	result, err := RunLocal(Config{InputPath: input, M: 2, R: 2, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}, keyCount{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Pair{{Key: "a", Value: "1"}, {Key: "b", Value: "1"}}; !slices.Equal(result.Output, want) {
+		t.Errorf("got %v, want %v", result.Output, want)
+	}
+	checkGoroutinesEnded(t, ".readInput")
+}
+
+func TestSortedOutputIsCanonical(t *testing.T) {
+	dir := t.TempDir()
+	var pairs []Pair
+	for i := 0; i < 200; i++ {
+		pairs = append(pairs, Pair{Key: strconv.Itoa(i), Value: fmt.Sprintf("w%d x%d w%d", i%7, i%3, i%11)})
+	}
+	input := filepath.Join(dir, "input.db")
+	if err := WriteInput(input, pairs); err != nil {
+		t.Fatal(err)
+	}
+
+	// Different task counts change which task produces each pair
+	var outputs [][]byte
+	for i, mr := range [][2]int{{3, 2}, {7, 5}} {
+		output := filepath.Join(dir, fmt.Sprintf("output%d.db", i))
+		_, err := RunLocal(Config{
+			Tempdir:      filepath.Join(dir, fmt.Sprintf("tmp%d", i)),
+			InputPath:    input,
+			OutputPath:   output,
+			M:            mr[0],
+			R:            mr[1],
+			SortedOutput: true,
+			OutputIndex:  true,
+			Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		}, wordCount{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, data)
+	}
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Error("sorted outputs of the same job differ")
+	}
+}
+
+func TestValidOutputName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"errors", true},
+		{"stats_2", true},
+		{"Errors", false},
+		{"ERRORS", false},
+		{"pairs", false},
+		{"sqlite_master", false},
+		{"errors_key", false},
+		{"pairs_key", false},
+		{"2stats", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := validOutputName(tt.name); got != tt.valid {
+			t.Errorf("validOutputName(%q) = %v, want %v", tt.name, got, tt.valid)
+		}
+	}
+}
+
+func TestMergeSideOutputsChecksNames(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "output.db")
+	db, err := createDatabase(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	cfg := &Config{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	parts := map[string][]outputPart{"x (key text); DROP TABLE pairs; --": {{Host: "w1", File: "job/side.db"}}}
+	if err := cfg.mergeSideOutputs(parts, dest, t.TempDir()); err == nil || !strings.Contains(err.Error(), "invalid side output name") {
+		t.Errorf("got error %v, want the name rejected", err)
+	}
+}
+
+func TestCompressFileLeavesNoPartialFile(t *testing.T) {
+	dir := t.TempDir()
+	// Opening a directory works but reading it fails, halfway into compressing
+	bad := filepath.Join(dir, "bad.db")
+	if err := os.Mkdir(bad, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := compressFile(bad, GzipCompression); err == nil {
+		t.Fatal("compressing a directory succeeded")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "bad.db" {
+			t.Errorf("failed compression left %s behind", entry.Name())
+		}
+	}
+}
+
+func TestDataHandlerAbortsCorruptFile(t *testing.T) {
+	dir := t.TempDir()
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(bytes.Repeat([]byte("data"), 10000))
+	zw.Close()
+	// Cut off the end, so decompressing fails after the first part went out
+	corrupt := compressed.Bytes()[:compressed.Len()/2]
+	if err := os.WriteFile(filepath.Join(dir, "part.db"+gzipExt), corrupt, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	handler := http.StripPrefix("/data", dataHandler(slog.New(slog.NewTextHandler(io.Discard, nil)), dir))
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	clients := map[string]*http.Client{
+		"server": {Transport: &http.Transport{DisableCompression: true}},
+		"local":  {Transport: handlerTransport{handler}},
+	}
+	for name, client := range clients {
+		resp, err := client.Get(server.URL + "/data/part.db")
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		if err == nil {
+			t.Errorf("%s: downloading a corrupt file succeeded", name)
+		}
+	}
+}
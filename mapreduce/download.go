@@ -0,0 +1,174 @@
+package mapreduce
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	fetchAttempts = 5   // Interrupted transfers are resumed up to this many times in total
+	fetchBackoff  = 100 // Milliseconds to wait before the first retry, doubled after each one
+)
+
+// Tracks a partially downloaded file so the transfer can be resumed
+type partial struct {
+	path         string
+	size         int64  // Bytes written so far
+	total        int64  // Full size of the representation, -1 if unknown
+	encoding     string // Content-Encoding of the bytes on disk
+	lastModified string // Validator sent with If-Range so a changed file restarts the transfer
+}
+
+// Download a file over HTTP and store in dest path. Interrupted transfers are resumed with Range requests
+// and retried with exponential backoff. Compressed transfers are decompressed once complete.
+func (cfg *Config) download(url, dest string) error {
+	part := &partial{path: dest + ".part", total: -1}
+	if err := os.Remove(part.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing stale partial file: %v", err)
+	}
+	defer os.Remove(part.path)
+
+	backoff := fetchBackoff * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		done, err := part.fetch(cfg, url)
+		if done {
+			break
+		}
+		if attempt == fetchAttempts {
+			return err
+		}
+		cfg.Logger.Warn("download interrupted, retrying", "url", url, "bytes", part.size, "try", attempt, "of", fetchAttempts, "backoff", backoff, "err", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	return part.finish(dest)
+}
+
+// Requests the remainder of the file and appends it to the partial file. Returns true when the file is complete.
+func (p *partial) fetch(cfg *Config, url string) (bool, error) {
+	if p.total >= 0 && p.size == p.total {
+		return true, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return false, fmt.Errorf("creating request: %v", err)
+	}
+	// Asking explicitly turns off the transport's transparent decompression, so we handle it here
+	req.Header.Set("Accept-Encoding", "gzip")
+	cfg.authorize(req)
+	if p.size > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", p.size))
+		if p.lastModified != "" {
+			req.Header.Set("If-Range", p.lastModified)
+		}
+	}
+
+	resp, err := cfg.httpClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("http get: %v", err)
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Full response, start over
+		flags |= os.O_TRUNC
+		p.size = 0
+		p.total = resp.ContentLength
+	case http.StatusPartialContent:
+		start, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return false, err
+		}
+		if start != p.size || resp.Header.Get("Content-Encoding") != p.encoding {
+			// Not the continuation we asked for, start from scratch next time
+			p.size, p.total = 0, -1
+			return false, fmt.Errorf("unexpected range response: %s", resp.Header.Get("Content-Range"))
+		}
+		flags |= os.O_APPEND
+		p.total = total
+	default:
+		return false, fmt.Errorf("http get: unexpected status %s", resp.Status)
+	}
+	p.encoding = resp.Header.Get("Content-Encoding")
+	p.lastModified = resp.Header.Get("Last-Modified")
+
+	out, err := os.OpenFile(p.path, flags, 0644)
+	if err != nil {
+		return false, fmt.Errorf("opening destination file: %v", err)
+	}
+	defer out.Close()
+
+	// Write the body to file, keeping whatever arrived before a failure
+	n, err := io.Copy(out, resp.Body)
+	p.size += n
+	bytesDownloaded.add(float64(n))
+	if err != nil {
+		return false, fmt.Errorf("copying data: %v", err)
+	}
+	if p.total >= 0 && p.size != p.total {
+		return false, fmt.Errorf("truncated transfer: got %d of %d bytes", p.size, p.total)
+	}
+
+	return true, nil
+}
+
+// Moves the completed download to dest, decompressing it if needed
+func (p *partial) finish(dest string) error {
+	if p.encoding != "gzip" {
+		if err := os.Rename(p.path, dest); err != nil {
+			return fmt.Errorf("moving download into place: %v", err)
+		}
+		return nil
+	}
+
+	in, err := os.Open(p.path)
+	if err != nil {
+		return fmt.Errorf("opening download: %v", err)
+	}
+	defer in.Close()
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return fmt.Errorf("reading compressed data: %v", err)
+	}
+	defer zr.Close()
+
+	// Create the file
+	out, err := os.Create(dest)
+	if err != nil {
+		return fmt.Errorf("creating destination file: %v", err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, zr); err != nil {
+		return fmt.Errorf("decompressing data: %v", err)
+	}
+
+	return nil
+}
+
+// Parses "bytes start-end/total" into its start and total (-1 if the total is "*")
+func parseContentRange(header string) (int64, int64, error) {
+	var start, end int64
+	var total string
+	if _, err := fmt.Sscanf(header, "bytes %d-%d/%s", &start, &end, &total); err != nil {
+		return 0, 0, fmt.Errorf("parsing Content-Range %q: %v", header, err)
+	}
+	if strings.TrimSpace(total) == "*" {
+		return start, -1, nil
+	}
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parsing Content-Range %q: %v", header, err)
+	}
+	return start, size, nil
+}
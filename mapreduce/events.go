@@ -0,0 +1,121 @@
+package mapreduce
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Event types
+const (
+	WorkerJoined   = "worker joined"
+	TaskAssigned   = "task assigned"
+	TaskReassigned = "task reassigned" // Assigned again after an earlier attempt
+	TaskFinished   = "task finished"
+	TaskFailed     = "task failed"
+	TaskStuck      = "task stuck"    // Progress stopped moving
+	TaskRequeued   = "task requeued" // Taken away from its worker, to be assigned again
+	PhaseChanged   = "phase changed"
+	FileCorrupted  = "file corrupted"
+)
+
+type (
+	// Event is one entry of the master's scheduling timeline
+	Event struct {
+		Time    time.Time
+		Type    string
+		Stage   string `json:",omitempty"` // Pipeline stage
+		Phase   string `json:",omitempty"` // Phase of the task, or the new phase for PhaseChanged
+		Task    int    // Task number, -1 if the event is not about a task
+		Attempt int    `json:",omitempty"`
+		Worker  string `json:",omitempty"`
+		Detail  string `json:",omitempty"`
+	}
+
+	// Append-only log of events, kept in memory and mirrored to a JSON lines file
+	eventLog struct {
+		events []Event
+		file   *os.File
+		stage  string // Stamped on events recorded from now on
+	}
+)
+
+// Opens an event log writing to path (in memory only if path is empty)
+func newEventLog(path string) (*eventLog, error) {
+	l := &eventLog{}
+	if path == "" {
+		return l, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening event log: %v", err)
+	}
+	l.file = file
+	return l, nil
+}
+
+// Appends an event, stamping it with the current time
+func (l *eventLog) record(e Event) {
+	if l == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.Stage = l.stage
+	l.events = append(l.events, e)
+	if l.file != nil {
+		data, _ := json.Marshal(e)
+		l.file.Write(append(data, '\n'))
+	}
+}
+
+func (l *eventLog) close() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// Records to l from now on, starting with the workers that joined before the job
+func (n *Node) startEvents(l *eventLog) {
+	n.events = l
+	addrs := make([]string, 0, len(n.Workers))
+	for addr := range n.Workers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		l.record(Event{Type: WorkerJoined, Task: -1, Worker: addr, Detail: "joined before the job"})
+	}
+}
+
+// Moves the node to a new phase and records the transition
+func (n *Node) setPhase(phase Phase) {
+	n.Phase = phase
+	n.events.record(Event{Type: PhaseChanged, Phase: phase.String(), Task: -1})
+}
+
+// Reads an event log written by the master
+func readEvents(path string) ([]Event, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening event log: %v", err)
+	}
+	defer file.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		events = append(events, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading event log: %v", err)
+	}
+	return events, nil
+}
@@ -0,0 +1,106 @@
+package mapreduce
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+type (
+	// IterativeJob runs the same client over its own output, as a pipeline of up to MaxIterations stages, until
+	// Converged returns true. Each iteration's map tasks read the previous iteration's outputs on the workers that
+	// wrote them, and are preferably given to those same workers.
+	IterativeJob struct {
+		Client        Interface
+		R             int                               // Number of reduce tasks of each iteration, 0 for map-only iterations
+		MaxIterations int                               // Stops after this many iterations even if not converged
+		Converged     func(it *Iteration) (bool, error) // Called on the master after each iteration, nil runs all MaxIterations
+	}
+
+	// Iteration describes a finished stage of a pipeline to its Converged function. It is only valid during the call.
+	Iteration struct {
+		Number   int      // 1-based position of the stage in the pipeline
+		Stage    string   // Name of the stage
+		Counters Counters // Summed over the tasks of the stage
+
+		input  func() ([]Pair, error)
+		output func() ([]Pair, error)
+	}
+)
+
+// Output downloads and returns the output of the stage, sorted by key, then value. It is read into memory, so this
+// is meant for small outputs such as cluster centers.
+func (it *Iteration) Output() ([]Pair, error) {
+	return it.output()
+}
+
+// Input returns what the map tasks of the stage read, sorted by key, then value: the job input for the first stage
+// and the outputs of the stage's inputs (the previous iteration) for later ones. It is read into memory like Output.
+func (it *Iteration) Input() ([]Pair, error) {
+	return it.input()
+}
+
+// Stages returns the pipeline running the job, with stages named iteration-1 to iteration-<MaxIterations>
+func (job IterativeJob) Stages() []Stage {
+	stages := make([]Stage, job.MaxIterations)
+	for i := range stages {
+		stages[i] = Stage{
+			Name:      fmt.Sprintf("iteration-%d", i+1),
+			Client:    job.Client,
+			R:         job.R,
+			Converged: job.Converged,
+		}
+	}
+	return stages
+}
+
+// RunIterative starts a master or worker node running an iterative job and blocks until it is done, see
+// RunPipeline. Workers must be started with the same MaxIterations as the master.
+func RunIterative(cfg Config, job IterativeJob) error {
+	if job.MaxIterations <= 0 {
+		return errors.New("an iterative job needs a positive MaxIterations")
+	}
+	return RunPipeline(cfg, job.Stages())
+}
+
+// Builds the iteration passed to Converged once a stage is done. Outputs are merged into files in dir on demand,
+// at most once per stage.
+func (cfg *Config) newIteration(number int, stage string, counters Counters, parts []outputPart, inputs []*Iteration, dir string) *Iteration {
+	it := &Iteration{Number: number, Stage: stage, Counters: counters}
+	it.output = sync.OnceValues(func() ([]Pair, error) {
+		path := filepath.Join(dir, fmt.Sprintf("stage_%d_output.db", number))
+		urls, sums := cfg.partURLs(parts)
+		db, err := cfg.mergeDatabases(urls, sums, path, filepath.Join(dir, "tmp.db"))
+		if err != nil {
+			return nil, fmt.Errorf("merging output of stage %d: %v", number, err)
+		}
+		db.Close()
+		return ReadOutput(path)
+	})
+	it.input = sync.OnceValues(func() ([]Pair, error) {
+		if len(inputs) == 0 {
+			return ReadOutput(cfg.InputPath)
+		}
+		var pairs []Pair
+		for _, input := range inputs {
+			output, err := input.Output()
+			if err != nil {
+				return nil, err
+			}
+			pairs = append(pairs, output...)
+		}
+		if len(inputs) > 1 {
+			slices.SortFunc(pairs, func(a, b Pair) int {
+				if c := cmp.Compare(a.Key, b.Key); c != 0 {
+					return c
+				}
+				return cmp.Compare(a.Value, b.Value)
+			})
+		}
+		return pairs, nil
+	})
+	return it
+}
@@ -0,0 +1,82 @@
+package mapreduce
+
+import "fmt"
+
+type (
+	// SetupMapper can be implemented by clients that prepare for a map task, e.g. by loading a lookup table.
+	// MapSetup is called before the first Map call of every map task with the task's context.
+	SetupMapper interface {
+		MapSetup(ctx *TaskContext) error
+	}
+
+	// CleanupMapper can be implemented by clients that finish a map task, e.g. by flushing pairs combined in
+	// memory. MapCleanup is called after the last Map call of every map task and must close output like Map.
+	CleanupMapper interface {
+		MapCleanup(ctx *TaskContext, output chan<- Pair) error
+	}
+
+	// SetupReducer is SetupMapper for reduce tasks
+	SetupReducer interface {
+		ReduceSetup(ctx *TaskContext) error
+	}
+
+	// CleanupReducer is CleanupMapper for reduce tasks
+	CleanupReducer interface {
+		ReduceCleanup(ctx *TaskContext, output chan<- Pair) error
+	}
+)
+
+// Calls the client's setup method for the phase of ctx, if it has one. A panic is returned as an error.
+func callSetup(ctx *TaskContext, client Interface) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s setup panicked: %v", ctx.Phase, r)
+		}
+	}()
+	switch ctx.Phase {
+	case Map:
+		if s, ok := findHook[SetupMapper](client); ok {
+			return s.MapSetup(ctx)
+		}
+	case Reduce:
+		if s, ok := findHook[SetupReducer](client); ok {
+			return s.ReduceSetup(ctx)
+		}
+	}
+	return nil
+}
+
+// Returns the client's cleanup method for the phase of ctx, or nil if it has none. A panic is returned as an error.
+func cleanupHook(ctx *TaskContext, client Interface) func(output chan<- Pair) error {
+	var cleanup func(output chan<- Pair) error
+	switch ctx.Phase {
+	case Map:
+		if c, ok := findHook[CleanupMapper](client); ok {
+			cleanup = func(output chan<- Pair) error { return c.MapCleanup(ctx, output) }
+		}
+	case Reduce:
+		if c, ok := findHook[CleanupReducer](client); ok {
+			cleanup = func(output chan<- Pair) error { return c.ReduceCleanup(ctx, output) }
+		}
+	}
+	if cleanup == nil {
+		return nil
+	}
+	return func(output chan<- Pair) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("%s cleanup panicked: %v", ctx.Phase, r)
+			}
+		}()
+		return cleanup(output)
+	}
+}
+
+// Closes the output of a client call that failed, unless the client already did, so the goroutine writing it
+// finishes
+func closeOutput(output chan<- Pair) {
+	defer func() {
+		recover()
+	}()
+	close(output)
+}
@@ -0,0 +1,227 @@
+package mapreduce
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+const localHost = "local" // Host name of the in-process data server used by RunLocal
+
+type (
+	// LocalResult is what RunLocal returns
+	LocalResult struct {
+		Output   []Pair            // Sorted by key, then value
+		Sides    map[string][]Pair // Side outputs by name, each sorted like Output
+		Counters Counters
+	}
+
+	// Serves requests with a handler in this process instead of going over the network
+	handlerTransport struct {
+		handler http.Handler
+	}
+)
+
+func (t handlerTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	// An aborted response fails the request, as a closed connection would
+	defer func() {
+		if rec := recover(); rec != nil {
+			if rec != http.ErrAbortHandler {
+				panic(rec)
+			}
+			resp, err = nil, fmt.Errorf("response to %s was aborted", req.URL)
+		}
+	}()
+	rec := httptest.NewRecorder()
+	t.handler.ServeHTTP(rec, req)
+	resp = rec.Result()
+	resp.Request = req
+	return resp, nil
+}
+
+// RunLocal runs the whole pipeline (split, map, shuffle, reduce and merge) in this process, with cfg.Workers
+// goroutines as workers and no network. The output db is also written to cfg.OutputPath if it is set, and
+// task files go to a fresh temporary directory if cfg.Tempdir is empty. cfg.M must be positive, and a zero cfg.R
+// runs a map-only job, so start from DefaultConfig for the usual task counts.
+// Meant for development and tests.
+func RunLocal(cfg Config, client Interface) (*LocalResult, error) {
+	return RunLocalPipeline(cfg, []Stage{{Client: client, R: cfg.R}})
+}
+
+// RunLocalPipeline is RunLocal for a pipeline of stages, see RunPipeline
+func RunLocalPipeline(cfg Config, stages []Stage) (*LocalResult, error) {
+	if err := validateStages(stages); err != nil {
+		return nil, err
+	}
+	if cfg.M <= 0 {
+		return nil, fmt.Errorf("M must be positive (M=%d)", cfg.M)
+	}
+	cfg.Master = true
+	if err := cfg.setup(); err != nil {
+		return nil, err
+	}
+	if cfg.Tempdir == "" {
+		dir, err := os.MkdirTemp("", "mapreduce")
+		if err != nil {
+			return nil, fmt.Errorf("creating temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		cfg.Tempdir = dir
+	}
+	cfg.Host = localHost
+	cfg.httpClient = &http.Client{Transport: handlerTransport{http.StripPrefix("/data", dataHandler(cfg.Logger, cfg.Tempdir))}}
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	jobDir := filepath.Join(cfg.Tempdir, cfg.JobID)
+	if err := os.MkdirAll(jobDir, fs.ModePerm); err != nil {
+		return nil, fmt.Errorf("creating job dir: %v", err)
+	}
+	defer os.RemoveAll(jobDir)
+	job := cfg.with("job", cfg.JobID)
+
+	sources, err := splitDatabase(job.Logger, cfg.InputPath, jobDir, "map_%d_source.db", cfg.M)
+	if err != nil {
+		return nil, fmt.Errorf("split db: %v", err)
+	}
+	sourceParts := make([]outputPart, len(sources))
+	for i, name := range sources {
+		sourceParts[i] = outputPart{Host: localHost, File: jobFile(cfg.JobID, "", name)}
+		if _, err := compressFile(filepath.Join(jobDir, name), cfg.Compression); err != nil {
+			return nil, fmt.Errorf("compressing source file: %v", err)
+		}
+	}
+	cache, err := job.serveCacheFiles(jobDir)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &LocalResult{Counters: make(Counters)}
+	outputs := make(map[string][]outputPart)
+	iterations := make(map[string]*Iteration)
+	sides := make(map[string][]outputPart)
+	var parts []outputPart
+	for s, stage := range stages {
+		inputs := sourceParts
+		var inputIterations []*Iteration
+		if s > 0 {
+			inputs = nil
+			for _, name := range stageInputs(stages, s) {
+				inputs = append(inputs, outputs[name]...)
+				inputIterations = append(inputIterations, iterations[name])
+			}
+		}
+		scfg := job
+		if stage.Name != "" {
+			scfg = job.with("stage", stage.Name)
+		}
+		mapTasks, reduceTasks := scfg.stageTasks(stage, inputs, cache)
+		M, R := len(mapTasks), len(reduceTasks)
+
+		// Map
+		mapResults, err := runLocalTasks(M, workers, func(i int) (JobDone, error) {
+			mapTasks[i].Attempt = 1
+			result, err := mapTasks[i].Process(scfg.with("phase", Map.String(), "task", i), stage.Client)
+			result.Addr = localHost
+			return result, err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("map task: %v", err)
+		}
+
+		// Reduce
+		for i := range reduceTasks {
+			for m, result := range mapResults {
+				reduceTasks[i].SourceHosts[m] = localHost
+				reduceTasks[i].SourceSums[m] = result.Files[reduceTasks[i].mapInputFile(m)]
+			}
+		}
+		reduceResults, err := runLocalTasks(R, workers, func(i int) (JobDone, error) {
+			reduceTasks[i].Attempt = 1
+			result, err := reduceTasks[i].Process(scfg.with("phase", Reduce.String(), "task", i), stage.Client)
+			result.Addr = localHost
+			return result, err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reduce task: %v", err)
+		}
+
+		stageCounters := make(Counters)
+		for _, r := range append(mapResults, reduceResults...) {
+			stageCounters.merge(r.Counters)
+		}
+		result.Counters.merge(stageCounters)
+
+		parts = scfg.finalParts(mapTasks, reduceTasks, mapResults, reduceResults)
+		outputs[stage.Name] = parts
+		addSideParts(sides, mapTasks, reduceTasks, mapResults, reduceResults)
+		iterations[stage.Name] = scfg.newIteration(s+1, stage.Name, stageCounters, parts, inputIterations, jobDir)
+		if stage.Converged != nil && s < len(stages)-1 {
+			converged, err := stage.Converged(iterations[stage.Name])
+			if err != nil {
+				return nil, fmt.Errorf("checking convergence of stage %q: %v", stage.Name, err)
+			}
+			if converged {
+				break
+			}
+		}
+	}
+
+	// Merge
+	outputURLs, outputSums := cfg.partURLs(parts)
+	outputPath := cfg.OutputPath
+	if outputPath == "" {
+		outputPath = filepath.Join(jobDir, "output.db")
+	}
+	if err := job.mergeOutput(outputURLs, outputSums, outputPath, jobDir); err != nil {
+		return nil, fmt.Errorf("merging reduce output dbs: %v", err)
+	}
+	if err := job.mergeSideOutputs(sides, outputPath, jobDir); err != nil {
+		return nil, fmt.Errorf("merging side outputs: %v", err)
+	}
+
+	if result.Output, err = ReadOutput(outputPath); err != nil {
+		return nil, err
+	}
+	if result.Sides, err = ReadSideOutputs(outputPath); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Runs tasks 0 to n-1 on a pool of goroutines, returning their results indexed by task number
+func runLocalTasks(n, workers int, process func(i int) (JobDone, error)) ([]JobDone, error) {
+	results := make([]JobDone, n)
+	errs := make([]error, n)
+	tasks := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range tasks {
+				results[i], errs[i] = process(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		tasks <- i
+	}
+	close(tasks)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("task %d: %v", i, err)
+		}
+	}
+	return results, nil
+}
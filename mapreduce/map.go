@@ -3,53 +3,107 @@ package mapreduce
 import (
 	"database/sql"
 	"fmt"
-	"hash/fnv"
-	"log"
+	"os"
+	"path"
 	"path/filepath"
 )
 
 type (
 	MapTask struct {
-		M, R       int    // total number of map and reduce tasks
-		N          int    // map task number, 0-based
-		SourceHost string // address of host with map input file
+		M, R        int         // total number of map and reduce tasks, R is 0 for map-only jobs
+		N           int         // map task number, 0-based
+		Job         string      // ID of the job the task belongs to
+		Stage       string      // pipeline stage the task belongs to, empty for single-stage jobs
+		Attempt     int         // attempt number assigned by the master, 1-based
+		SourceHost  string      // address of host with map input file
+		Source      string      // map input file on SourceHost, the task's shard of the job input if empty
+		SourceSum   FileSum     // checksum of the map input file
+		Compression string      // codec used for the intermediate output files
+		Cache       []CacheFile // files of the distributed cache
 	}
 )
 
 // Filename helpers
 
+// Task files live in a directory per job (and per stage of a pipeline), so jobs sharing a worker don't clash
+func jobFile(job, stage, name string) string {
+	return path.Join(job, stage, name)
+}
+
 func (task *MapTask) sourceFile() string {
-	return fmt.Sprintf("map_%d_source.db", task.N)
+	if task.Source != "" {
+		return task.Source
+	}
+	// The input is split once per job
+	return jobFile(task.Job, "", fmt.Sprintf("map_%d_source.db", task.N))
 }
 
 func (task *MapTask) inputFile() string {
-	return fmt.Sprintf("map_%d_input.db", task.N)
+	return jobFile(task.Job, task.Stage, fmt.Sprintf("map_%d_input.db", task.N))
 }
 
 func (task *MapTask) outputFile(reduceTaskNumber int) string {
-	return fmt.Sprintf("map_%d_output_%d.db", task.N, reduceTaskNumber)
+	return jobFile(task.Job, task.Stage, fmt.Sprintf("map_%d_output_%d.db", task.N, reduceTaskNumber))
+}
+
+func (task *MapTask) sideFile(name string) string {
+	return jobFile(task.Job, task.Stage, fmt.Sprintf("map_%d_side_%s.db", task.N, name))
+}
+
+// Number of output files: one per reduce task, or a single final part in a map-only job
+func (task *MapTask) partitions() int {
+	if task.R == 0 {
+		return 1
+	}
+	return task.R
 }
 
 // Actual mapper logic
 
-func (task *MapTask) Process(tempdir string, client Interface) error {
+// Runs the map task, returning the result to report to the master (without the worker address)
+func (task *MapTask) Process(cfg *Config, client Interface) (JobDone, error) {
+	tempdir := cfg.Tempdir
+	result := JobDone{
+		Job:    task.Job,
+		Stage:  task.Stage,
+		Phase:  Map,
+		Number: task.N,
+		Files:  make(map[string]FileSum),
+	}
+
+	if err := os.MkdirAll(filepath.Join(tempdir, task.Job, task.Stage), os.ModePerm); err != nil {
+		return result, fmt.Errorf("creating job dir: %v", err)
+	}
+
+	// Fetch the cache files before any client code runs
+	cache, err := cfg.fetchCache(task.Job, task.Cache)
+	if err != nil {
+		return result, fmt.Errorf("fetching cache files: %w", err)
+	}
+	defer cache.close()
+
 	// Download input file
 	inputFile := filepath.Join(tempdir, task.inputFile())
-	if err := download(makeURL(task.SourceHost, task.sourceFile()), inputFile); err != nil {
-		return fmt.Errorf("downloading source file: %v", err)
+	endDownload := cfg.spans.start("download", "file", task.sourceFile())
+	err = cfg.downloadVerified(cfg.makeURL(task.SourceHost, task.sourceFile()), inputFile, task.SourceSum)
+	endDownload()
+	if err != nil {
+		return result, fmt.Errorf("downloading source file: %w", err)
 	}
 
 	// Create output queries
-	outStmts := make([]*sql.Stmt, task.R)
-	for i := 0; i < task.R; i++ {
+	outDBs := make([]*sql.DB, task.partitions())
+	outStmts := make([]*sql.Stmt, task.partitions())
+	for i := range outDBs {
 		db, err := createDatabase(filepath.Join(tempdir, task.outputFile(i)))
 		if err != nil {
-			return fmt.Errorf("creating output files: %v", err)
+			return result, fmt.Errorf("creating output files: %v", err)
 		}
 		stmt, err := db.Prepare("INSERT INTO pairs (key, value) values (?, ?)")
 		if err != nil {
-			return fmt.Errorf("preparing insert statement: %v", err)
+			return result, fmt.Errorf("preparing insert statement: %v", err)
 		}
+		outDBs[i] = db
 		outStmts[i] = stmt
 		defer stmt.Close()
 		defer db.Close()
@@ -60,66 +114,150 @@ func (task *MapTask) Process(tempdir string, client Interface) error {
 	// Open input db
 	db, err := openDatabase(inputFile)
 	if err != nil {
-		return fmt.Errorf("opening input db: %v", err)
+		return result, fmt.Errorf("opening input db: %v", err)
 	}
 	defer db.Close()
 
+	total, err := countPairs(db)
+	if err != nil {
+		return result, fmt.Errorf("sizing input db: %v", err)
+	}
+	cfg.progress.setTotal(total)
+
 	rows, err := db.Query("SELECT key, value FROM pairs")
 	if err != nil {
-		return fmt.Errorf("querying input db: %v", err)
+		return result, fmt.Errorf("querying input db: %v", err)
 	}
 	defer rows.Close()
 
+	// Reduce task of each output key
+	var partition func(key string) (int, error)
+	if task.R > 0 {
+		partition = partitionFunc(client, task.R)
+	}
+
 	// Stats
 	inCount, outCount := 0, 0
+	ctx := newTaskContext(Map, task.N)
+	ctx.sides = newSideOutputs(tempdir, task.sideFile)
+	defer ctx.sides.close()
+	ctx.cache = cache
+	endMap := cfg.spans.start("map")
+
+	if err := callSetup(ctx, client); err != nil {
+		return result, fmt.Errorf("client map setup failure: %v", err)
+	}
 
 	for rows.Next() {
+		if err := cfg.progress.check(); err != nil {
+			return result, err
+		}
 		inCount++
+		cfg.progress.add(1)
 		var key, value string
 		if err := rows.Scan(&key, &value); err != nil {
-			return fmt.Errorf("reading a row from input db: %v", err)
+			return result, fmt.Errorf("reading a row from input db: %v", err)
 		}
 
 		// Call client map and gather output
 		mapOut := make(chan Pair, 200)
-		done := make(chan error)
+		done := make(chan error, 1)
 
 		// Goroutine for writing intermediate kv
-		go task.writeOutput(mapOut, done, outStmts, &outCount)
+		go task.writeOutput(mapOut, done, outStmts, partition, &outCount)
 
-		if err := client.Map(key, value, mapOut); err != nil {
-			return fmt.Errorf("client map failure: %v", err)
+		if err := callMap(ctx, client, key, value, mapOut); err != nil {
+			closeOutput(mapOut)
+			<-done
+			return result, fmt.Errorf("client map failure: %v", err)
 		}
 
 		// Wait for writing to finish
 		if err := <-done; err != nil {
-			return fmt.Errorf("writing output: %v", err)
+			return result, fmt.Errorf("writing output: %v", err)
 		}
 	}
 
 	// Check for errors from iterating over rows.
 	if err := rows.Err(); err != nil {
-		return fmt.Errorf("iterating over downloaded db: %v", err)
+		return result, fmt.Errorf("iterating over downloaded db: %v", err)
 	}
 
+	// The cleanup can emit final pairs, like a Map call
+	if cleanup := cleanupHook(ctx, client); cleanup != nil {
+		mapOut := make(chan Pair, 200)
+		done := make(chan error, 1)
+		go task.writeOutput(mapOut, done, outStmts, partition, &outCount)
+		if err := cleanup(mapOut); err != nil {
+			closeOutput(mapOut)
+			<-done
+			return result, fmt.Errorf("client map cleanup failure: %v", err)
+		}
+		if err := <-done; err != nil {
+			return result, fmt.Errorf("writing output: %v", err)
+		}
+	}
+	endMap()
+
+	// Close, checksum and compress the intermediate files so they can be served
+	endWrites := cfg.spans.start("partition writes", "files", task.partitions())
+	defer endWrites()
+	for i := range outDBs {
+		outStmts[i].Close()
+		if err := outDBs[i].Close(); err != nil {
+			return result, fmt.Errorf("closing output db: %v", err)
+		}
+		path := filepath.Join(tempdir, task.outputFile(i))
+		sum, err := sumFile(path)
+		if err != nil {
+			return result, fmt.Errorf("checksumming output file: %v", err)
+		}
+		result.Files[task.outputFile(i)] = sum
+		saved, err := compressFile(path, task.Compression)
+		if err != nil {
+			return result, fmt.Errorf("compressing output file: %v", err)
+		}
+		result.Stats.BytesSaved += saved
+	}
+
+	if err := ctx.sides.finish(task.Compression, &result); err != nil {
+		return result, err
+	}
+
+	result.Counters = ctx.snapshot()
+	result.Stats.InPairs, result.Stats.OutPairs = inCount, outCount
+
 	// Log stats
-	log.Printf("map task %d processed %d pairs, generated %d pairs, created %d intermediate output files\n", task.N, inCount, outCount, task.R)
+	mapInputPairs.add(float64(inCount))
+	mapOutputPairs.add(float64(outCount))
+	cfg.Logger.Info("map task completed", "in_pairs", inCount, "out_pairs", outCount, "output_files", task.partitions(), "bytes_saved", result.Stats.BytesSaved)
 
-	return nil
+	return result, nil
 }
 
-func (task *MapTask) writeOutput(output <-chan Pair, done chan<- error, outStmts []*sql.Stmt, count *int) {
+func (task *MapTask) writeOutput(output <-chan Pair, done chan<- error, outStmts []*sql.Stmt, partition func(key string) (int, error), count *int) {
+	var err error
 	for pair := range output {
+		if err != nil {
+			// The rest is read and dropped so the Map call can finish, the task fails anyway
+			continue
+		}
 		*count++
-		// Find output file
-		hash := fnv.New32() // from the stdlib package hash/fnv
-		hash.Write([]byte(pair.Key))
-		r := int(hash.Sum32() % uint32(task.R))
-		if _, err := outStmts[r].Exec(pair.Key, pair.Value); err != nil {
-			done <- fmt.Errorf("inserting into output db: %v", err)
-			return
+		// Find output file, map-only jobs have just one
+		r := 0
+		if partition != nil {
+			if r, err = partition(pair.Key); err != nil {
+				continue
+			}
+			if r < 0 || r >= task.R {
+				err = fmt.Errorf("partition %d of key %q is out of range for %d reduce tasks", r, pair.Key, task.R)
+				continue
+			}
+		}
+		if _, execErr := outStmts[r].Exec(pair.Key, pair.Value); execErr != nil {
+			err = fmt.Errorf("inserting into output db: %v", execErr)
 		}
 	}
 
-	done <- nil
+	done <- err
 }
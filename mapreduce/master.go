@@ -1,36 +1,290 @@
 package mapreduce
 
 import (
+	"errors"
 	"fmt"
 	"io/fs"
-	"log"
 	"os"
 	"path/filepath"
+	"time"
 )
 
-func startMaster(client Interface, inputPath, outputPath string) error {
-	// Split the input file and start an HTTP server to serve source chunks to map workers.
-	if err := os.Mkdir(tempdir, fs.ModePerm); err != nil {
+var errCanceled = errors.New("job canceled")
+
+const maxTaskFailures = 4 // A task failing this many times fails the job
+
+func startMaster(cfg *Config, stages []Stage) error {
+	// Start an HTTP server to serve source chunks to map workers.
+	if err := os.Mkdir(cfg.Tempdir, fs.ModePerm); err != nil {
 		return fmt.Errorf("creating temp dir: %v", err)
 	}
-	defer os.RemoveAll(tempdir)
+	defer os.RemoveAll(cfg.Tempdir)
+
+	// Create and start an RPC server to handle incoming client requests.
+	//  Note that it uses the same HTTP server that shares static files.
+	masterNode := Node{
+		Phase:   Wait,
+		Done:    make(chan JobDone, 10),
+		wake:    make(chan struct{}, 1),
+		Workers: make(map[string]*WorkerInfo),
+		cfg:     cfg,
+		queued:  make(chan struct{}, 1),
+	}
+	actor, err := masterNode.startRPC()
+	if err != nil {
+		return fmt.Errorf("can't start RPC server: %v", err)
+	}
+	handleStatus(cfg.mux, actor, cfg.Logger)
+
+	// Start http server from tempdir, once the RPC server is ready for workers
+	go cfg.localServe()
+
+	if cfg.Serve {
+		cfg.Logger.Info("coordinator waiting for jobs", "host", cfg.Host)
+		actor.serveJobs(cfg, stages)
+		return nil
+	}
 
-	// Start http server from tempdir
-	go localServe(host, tempdir)
+	if err := actor.runJob(cfg.with("job", cfg.JobID), stages); err != nil {
+		return err
+	}
 
-	_, err := splitDatabase(inputPath, tempdir, "map_%d_source.db", M)
+	// Tell all workers to shut down, then shut down the master.
+	for _, addr := range actor.workers() {
+		cfg.Logger.Info("shutting down worker", "worker", addr)
+		if err := cfg.call(addr, "NodeActor.Signal", struct{}{}, nil); err != nil {
+			cfg.Logger.Warn("error shutting down worker", "worker", addr, "err", err)
+		}
+	}
+
+	cfg.Logger.Info("master shutting down")
+
+	return nil
+}
+
+// Runs one job (every stage of the pipeline) on the connected workers, from splitting the input to writing the output
+func (a NodeActor) runJob(cfg *Config, stages []Stage) error {
+	M := cfg.M
+
+	// All spans of the job hang off a root span that covers the whole run
+	var rootID string
+	jobStart := time.Now()
+	if cfg.Trace {
+		rootID = newSpanID()
+		cfg.spans = newTracer(TraceContext{TraceID: cfg.JobID, ParentID: rootID}, cfg.Host)
+	}
+
+	// Files of the job live in their own directory, which is served under the job ID
+	jobDir := filepath.Join(cfg.Tempdir, cfg.JobID)
+	if err := os.Mkdir(jobDir, fs.ModePerm); err != nil {
+		return fmt.Errorf("creating job dir: %v", err)
+	}
+	defer os.RemoveAll(jobDir)
+
+	// Record the scheduling timeline next to the output, from before the split so workers joining during it are in
+	events, err := newEventLog(cfg.OutputPath + ".events.jsonl")
+	if err != nil {
+		return err
+	}
+	defer events.close()
+	a.run(func(n *Node) {
+		n.startEvents(events)
+	})
+	// Events after the job ends don't belong to it
+	defer a.run(func(n *Node) {
+		n.events = nil
+	})
+
+	// Split the input file to serve source chunks to map workers.
+	endSplit := cfg.spans.start("split", "input", cfg.InputPath, "shards", M)
+	sources, err := splitDatabase(cfg.Logger, cfg.InputPath, jobDir, "map_%d_source.db", M)
+	endSplit()
 	if err != nil {
 		return fmt.Errorf("split db: %v", err)
 	}
+	var sourceSaved int64
+	sourceParts := make([]outputPart, M)
+	for i, name := range sources {
+		sourceParts[i] = outputPart{Host: cfg.Host, File: jobFile(cfg.JobID, "", name)}
+		if sourceParts[i].Sum, err = sumFile(filepath.Join(jobDir, name)); err != nil {
+			return fmt.Errorf("checksumming source file: %v", err)
+		}
+		saved, err := compressFile(filepath.Join(jobDir, name), cfg.Compression)
+		if err != nil {
+			return fmt.Errorf("compressing source file: %v", err)
+		}
+		sourceSaved += saved
+	}
+	if sourceSaved > 0 {
+		cfg.Logger.Info("compressed source files", "bytes_saved", sourceSaved)
+	}
+	cache, err := cfg.serveCacheFiles(jobDir)
+	if err != nil {
+		return err
+	}
+
+	bytesSaved := sourceSaved
+	counters := make(Counters)
+	var report Report
+	outputs := make(map[string][]outputPart) // Final parts of the finished stages, by name
+	var parts []outputPart                   // Final parts of the last finished stage
+	iterations := make(map[string]*Iteration)
+	sides := make(map[string][]outputPart) // Side output files of all stages, by output name
+	for i, stage := range stages {
+		inputs := sourceParts
+		if i > 0 {
+			inputs = nil
+			for _, name := range stageInputs(stages, i) {
+				inputs = append(inputs, outputs[name]...)
+			}
+		}
+		scfg := cfg
+		if stage.Name != "" {
+			scfg = cfg.with("stage", stage.Name)
+			scfg.Logger.Info("starting stage", "map_tasks", len(inputs), "reduce_tasks", stage.R)
+		}
+		mapTasks, reduceTasks := scfg.stageTasks(stage, inputs, cache)
+
+		a.run(func(n *Node) {
+			n.startJob(scfg, stage.Name, i < len(stages)-1, mapTasks, reduceTasks, events)
+			if i > 0 {
+				// Workers keep asking for tasks between stages, so go on right away
+				n.setPhase(Map)
+				n.Started = time.Now()
+			}
+		})
+		if i == 0 {
+			a.startWorkers(cfg)
+		}
+
+		// Wait until all jobs are complete, watching for tasks that stop making progress.
+		stopWatch := make(chan struct{})
+		go a.watchProgress(stopWatch)
+		mapResults, reduceResults, err := a.waitForJobs()
+		close(stopWatch)
+		if err != nil {
+			return err
+		}
+
+		// Aggregate user counters
+		stageCounters := make(Counters)
+		for _, result := range append(mapResults, reduceResults...) {
+			bytesSaved += result.Stats.BytesSaved
+			stageCounters.merge(result.Counters)
+		}
+		counters.merge(stageCounters)
+
+		var stageReport Report
+		a.run(func(n *Node) {
+			stageReport = n.report(mapResults, reduceResults)
+		})
+		if i == 0 {
+			report = stageReport
+		} else {
+			report.add(stageReport)
+		}
+
+		parts = scfg.finalParts(mapTasks, reduceTasks, mapResults, reduceResults)
+		outputs[stage.Name] = parts
+		addSideParts(sides, mapTasks, reduceTasks, mapResults, reduceResults)
+		if len(stages) > 1 {
+			scfg.Logger.Info("stage completed", "parts", len(parts))
+		}
+
+		var inputIterations []*Iteration
+		if i > 0 {
+			for _, name := range stageInputs(stages, i) {
+				inputIterations = append(inputIterations, iterations[name])
+			}
+		}
+		iterations[stage.Name] = scfg.newIteration(i+1, stage.Name, stageCounters, parts, inputIterations, jobDir)
+		if stage.Converged != nil && i < len(stages)-1 {
+			converged, err := stage.Converged(iterations[stage.Name])
+			if err != nil {
+				return fmt.Errorf("checking convergence of stage %q: %v", stage.Name, err)
+			}
+			if converged {
+				scfg.Logger.Info("converged, skipping the remaining stages", "stages", i+1)
+				// Let workers go once the output is merged
+				a.run(func(n *Node) {
+					n.more = false
+				})
+				break
+			}
+		}
+	}
+	cfg.Logger.Info("all tasks completed", "bytes_saved", bytesSaved)
+
+	// Create correct urls
+	outputURLs, outputSums := cfg.partURLs(parts)
+
+	// Describe the job for downstream consumers, whether or not the merge works out
+	report.Counters = counters
+	report.Totals.BytesSaved += sourceSaved
+	reportPath := cfg.OutputPath + ".report.json"
+
+	// Gather the reduce outputs and join them into a single output file.
+	endMerge := cfg.spans.start("final merge", "files", len(outputURLs), "sorted", cfg.SortedOutput)
+	err = cfg.mergeOutput(outputURLs, outputSums, cfg.OutputPath, jobDir)
+	if err == nil {
+		// Each side output becomes a table of the output db
+		err = cfg.mergeSideOutputs(sides, cfg.OutputPath, jobDir)
+	}
+	endMerge()
+	if err != nil {
+		err = fmt.Errorf("merging reduce output dbs: %v", err)
+		if saveErr := report.save(reportPath, err); saveErr != nil {
+			cfg.Logger.Error("error saving report", "err", saveErr)
+		}
+		return err
+	}
+	cfg.Logger.Info("output db written", "path", cfg.OutputPath, "sorted", cfg.SortedOutput, "indexed", cfg.OutputIndex, "side_outputs", len(sides))
+
+	if len(counters) > 0 {
+		counters.log(cfg.Logger)
+		if err := counters.save(cfg.OutputPath + ".counters.json"); err != nil {
+			return fmt.Errorf("saving counters: %v", err)
+		}
+	}
+
+	if err := report.save(reportPath, nil); err != nil {
+		return fmt.Errorf("saving report: %v", err)
+	}
+	cfg.Logger.Info("job report written", "path", reportPath)
 
-	// Generate the full set of map tasks and reduce tasks. Note that reduce tasks will be incomplete initially, because they require a list of the hosts that handled each map task.
+	if cfg.Trace {
+		cfg.spans.add(Span{TraceID: cfg.JobID, ID: rootID, Name: "job", Host: cfg.Host, Start: jobStart, Duration: time.Since(jobStart)})
+		tracePath := cfg.OutputPath + ".trace.json"
+		spans := cfg.spans.collected()
+		if err := writeChromeTrace(tracePath, spans); err != nil {
+			return err
+		}
+		cfg.Logger.Info("trace written", "path", tracePath, "spans", len(spans))
+	}
+
+	a.run(func(n *Node) {
+		n.setPhase(Finish)
+	})
+
+	return nil
+}
+
+// Generates the full set of map tasks of a stage, one per input part, and its reduce tasks. Note that reduce tasks will be incomplete initially, because they require a list of the hosts that handled each map task.
+func (cfg *Config) stageTasks(stage Stage, inputs []outputPart, cache []CacheFile) ([]MapTask, []ReduceTask) {
+	M, R := len(inputs), stage.R
 	mapTasks := make([]MapTask, M)
-	for i := 0; i < M; i++ {
+	for i, input := range inputs {
 		mapTasks[i] = MapTask{
-			M:          M,
-			R:          R,
-			N:          i,
-			SourceHost: host,
+			M:           M,
+			R:           R,
+			N:           i,
+			Job:         cfg.JobID,
+			Stage:       stage.Name,
+			SourceHost:  input.Host,
+			Source:      input.File,
+			SourceSum:   input.Sum,
+			Compression: cfg.Compression,
+			Cache:       cache,
 		}
 	}
 	reduceTasks := make([]ReduceTask, R)
@@ -39,130 +293,205 @@ func startMaster(client Interface, inputPath, outputPath string) error {
 			M:           M,
 			R:           R,
 			N:           i,
+			Job:         cfg.JobID,
+			Stage:       stage.Name,
 			SourceHosts: make([]string, M),
+			SourceSums:  make([]FileSum, M),
+			Compression: cfg.Compression,
+			Cache:       cache,
 		}
 	}
+	return mapTasks, reduceTasks
+}
 
-	// Create and start an RPC server to handle incoming client requests.
-	//  Note that it can use the same HTTP server that shares static files.
-	masterNode := Node{
-		Phase:       Wait,
-		NextJob:     0,
-		DoneJobs:    0,
-		MapTasks:    mapTasks,
-		ReduceTasks: reduceTasks,
-		Done:        make(chan JobDone, 10),
-		Workers:     make(map[string]struct{}),
-	}
-	actor, err := masterNode.startRPC()
-	if err != nil {
-		return fmt.Errorf("can't start RPC server: %v", err)
-	}
-
+// Moves the first stage to the map phase, after a keypress if workers wait for the master's signal
+func (a NodeActor) startWorkers(cfg *Config) {
 	// Phase -1 is waiting phase
-	if wait {
-		log.Printf("Master @[%s] waiting for user input to start...\n", host)
+	if cfg.Wait {
+		cfg.Logger.Info("master waiting for user input to start", "host", cfg.Host)
 		fmt.Println("Press ENTER to start...")
 		var ignore string
 		fmt.Scanln(&ignore)
-		masterNode.Phase = Map
+		a.run(func(n *Node) {
+			n.setPhase(Map)
+			n.Started = time.Now()
+		})
 		fmt.Println("Starting workers...")
-		for workerAddr := range masterNode.Workers {
-			log.Printf("starting worker @[%s]", workerAddr)
-			if err := call(workerAddr, "NodeActor.Signal", struct{}{}, nil); err != nil {
-				log.Printf("error contacting worker @[%s]: %v\n", workerAddr, err)
+		for _, workerAddr := range a.workers() {
+			cfg.Logger.Info("starting worker", "worker", workerAddr)
+			if err := cfg.call(workerAddr, "NodeActor.Signal", struct{}{}, nil); err != nil {
+				cfg.Logger.Warn("error contacting worker", "worker", workerAddr, "err", err)
 			}
 		}
 	} else {
-		masterNode.Phase = Map
-		log.Printf("Master @[%s] waiting for workers...\n", host)
+		a.run(func(n *Node) {
+			n.setPhase(Map)
+			n.Started = time.Now()
+		})
+		cfg.Logger.Info("master waiting for workers", "host", cfg.Host)
 	}
+}
 
-	// Wait until all jobs are complete.
-	reduceHosts := actor.waitForJobs(masterNode.Done)
-
-	// Create correct urls
-	outputURLs := make([]string, R)
-	for i := 0; i < R; i++ {
-		outputURLs[i] = makeURL(reduceHosts[i], reduceTasks[i].outputFile())
+// Returns the files making up the output of a stage: the reduce outputs, or the map outputs of a map-only stage
+func (cfg *Config) finalParts(mapTasks []MapTask, reduceTasks []ReduceTask, mapResults, reduceResults []JobDone) []outputPart {
+	var parts []outputPart
+	if len(reduceTasks) == 0 {
+		for i, result := range mapResults {
+			file := mapTasks[i].outputFile(0)
+			parts = append(parts, outputPart{Host: result.Addr, File: file, Sum: result.Files[file]})
+		}
+		return parts
 	}
-
-	// Gather the reduce outputs and join them into a single output file.
-	outDB, err := mergeDatabases(outputURLs, outputPath, filepath.Join(tempdir, "tmp.db"))
-	if err != nil {
-		return fmt.Errorf("merging reduce output dbs: %v", err)
+	for i, result := range reduceResults {
+		file := reduceTasks[i].outputFile()
+		parts = append(parts, outputPart{Host: result.Addr, File: file, Sum: result.Files[file]})
 	}
-	defer outDB.Close()
-
-	log.Printf("Output db located at %s\n", outputPath)
+	return parts
+}
 
-	masterNode.Phase = Finish
+// Resets the scheduling state of the node for a new job, or the next stage of a pipeline
+func (n *Node) startJob(cfg *Config, stage string, more bool, mapTasks []MapTask, reduceTasks []ReduceTask, events *eventLog) {
+	n.cfg = cfg
+	n.events = events
+	n.events.stage = stage
+	n.JobID = cfg.JobID
+	n.Stage, n.more = stage, more
+	n.Phase = Wait
+	n.NextJob, n.DoneJobs = 0, 0
+	n.MapTasks, n.ReduceTasks = mapTasks, reduceTasks
+	n.MapInfo, n.ReduceInfo = make([]TaskInfo, len(mapTasks)), make([]TaskInfo, len(reduceTasks))
+	n.Started = time.Time{}
+	n.Corruptions = nil
+	n.canceled, n.failed = false, nil
+}
 
-	// Tell all workers to shut down, then shut down the master.
-	for addr := range masterNode.Workers {
-		log.Printf("shutting down worker @[%s]", addr)
-		if err := call(addr, "NodeActor.Signal", struct{}{}, nil); err != nil {
-			log.Printf("error shutting down worker: %v", err)
+// Returns the addresses of the connected workers
+func (a NodeActor) workers() []string {
+	var addrs []string
+	a.run(func(n *Node) {
+		for addr := range n.Workers {
+			addrs = append(addrs, addr)
 		}
-	}
-
-	log.Println("Master shutting down...")
-
-	return nil
+	})
+	return addrs
 }
 
-func (a *NodeActor) waitForJobs(taskDone <-chan JobDone) []string {
-	// Build sourcehosts as tasks complete
-	mapHosts := make([]string, M)
-	reduceHosts := make([]string, R)
+// Returns the results of all map and reduce tasks, indexed by task number
+func (a NodeActor) waitForJobs() ([]JobDone, []JobDone, error) {
+	var mapResults, reduceResults []JobDone
+	var taskDone <-chan JobDone
+	var wake <-chan struct{}
+	a.run(func(n *Node) {
+		mapResults = make([]JobDone, len(n.MapTasks))
+		reduceResults = make([]JobDone, len(n.ReduceTasks))
+		taskDone, wake = n.Done, n.wake
+	})
 
 	// As tasks are completed, they are sent to this channel
-	for task := range taskDone {
+	for {
+		var task JobDone
+		woken := false
+		select {
+		case task = <-taskDone:
+		case <-wake:
+			// Canceled or failed
+			woken = true
+		}
 		var currPhase Phase
+		var canceled bool
+		var failed error
 		// Wrap data access in actor model to prevent race conditions
 		a.run(func(n *Node) {
+			if canceled, failed = n.canceled, n.failed; canceled || failed != nil || woken {
+				return
+			}
+			logger := n.cfg.Logger.With("phase", task.Phase.String(), "task", task.Number, "worker", task.Addr)
+			info := n.taskInfo(task.Phase, task.Number)
 			switch {
-			case n.Phase == Map || n.Phase == MapDone:
-				log.Printf("Map task %d completed by [%s]\n", task.Number, task.Addr)
-				mapHosts[task.Number] = task.Addr
+			case task.Job != n.JobID || task.Stage != n.Stage:
+				// Finished after its job or stage ended
+				logger.Info("ignoring task of another job or stage", "task_job", task.Job, "task_stage", task.Stage)
+			case info == nil:
+				logger.Warn("ignoring completion of an unknown task")
+			case info.State == Completed:
+				// Only the first attempt to finish counts, so its counters are only added once
+				logger.Info("ignoring duplicate task completion")
+			case task.Phase == Map && (n.Phase == Map || n.Phase == MapDone):
+				logger.Info("task completed", "attempt", n.MapInfo[task.Number].Attempts)
+				n.events.record(Event{Type: TaskFinished, Phase: Map.String(), Task: task.Number, Attempt: n.MapInfo[task.Number].Attempts, Worker: task.Addr})
+				mapResults[task.Number] = task
+				n.MapInfo[task.Number].complete(task.Addr)
+				n.traceDone(n.MapInfo[task.Number], task)
+				tasksCompleted.add(1, Map.String())
 				n.DoneJobs++
 
 				// Done with all map jobs
-				if n.DoneJobs == M {
-					// Fill in source hosts for reduce tasks
-					for i := 0; i < R; i++ {
-						n.ReduceTasks[i].SourceHosts = mapHosts
+				if n.DoneJobs == len(n.MapTasks) {
+					// Fill in source hosts and checksums for reduce tasks
+					for i := range n.ReduceTasks {
+						for m, result := range mapResults {
+							n.ReduceTasks[i].SourceHosts[m] = result.Addr
+							n.ReduceTasks[i].SourceSums[m] = result.Files[n.ReduceTasks[i].mapInputFile(m)]
+						}
 					}
 
-					log.Println("Map phase completed")
+					n.cfg.Logger.Info("map phase completed")
 
-					n.Phase = Reduce
+					if len(n.ReduceTasks) == 0 {
+						// Map-only job, the map outputs are the final parts
+						n.setPhase(Merge)
+						break
+					}
+					n.setPhase(Reduce)
 					n.NextJob = 0
 					n.DoneJobs = 0
 				}
 
-			case n.Phase == Reduce || n.Phase == ReduceDone:
-				log.Printf("Reduce task %d completed by [%s]\n", task.Number, task.Addr)
-				reduceHosts[task.Number] = task.Addr
+			case task.Phase == Map && (n.Phase == Reduce || n.Phase == ReduceDone):
+				// A map task whose files were lost ran again, reduce tasks download from the new attempt
+				logger.Info("task completed", "attempt", n.MapInfo[task.Number].Attempts)
+				n.events.record(Event{Type: TaskFinished, Phase: Map.String(), Task: task.Number, Attempt: n.MapInfo[task.Number].Attempts, Worker: task.Addr})
+				mapResults[task.Number] = task
+				n.MapInfo[task.Number].complete(task.Addr)
+				n.traceDone(n.MapInfo[task.Number], task)
+				tasksCompleted.add(1, Map.String())
+				for i := range n.ReduceTasks {
+					n.ReduceTasks[i].SourceHosts[task.Number] = task.Addr
+					n.ReduceTasks[i].SourceSums[task.Number] = task.Files[n.ReduceTasks[i].mapInputFile(task.Number)]
+				}
+
+			case task.Phase == Reduce && (n.Phase == Reduce || n.Phase == ReduceDone):
+				logger.Info("task completed", "attempt", n.ReduceInfo[task.Number].Attempts)
+				n.events.record(Event{Type: TaskFinished, Phase: Reduce.String(), Task: task.Number, Attempt: n.ReduceInfo[task.Number].Attempts, Worker: task.Addr})
+				reduceResults[task.Number] = task
+				n.ReduceInfo[task.Number].complete(task.Addr)
+				n.traceDone(n.ReduceInfo[task.Number], task)
+				tasksCompleted.add(1, Reduce.String())
 				n.DoneJobs++
 
 				// Done with all reduce jobs
-				if n.DoneJobs == R {
-					log.Println("Reduce phase completed")
+				if n.DoneJobs == len(n.ReduceTasks) {
+					n.cfg.Logger.Info("reduce phase completed")
 
-					n.Phase = Merge
+					n.setPhase(Merge)
 				}
 			default:
 				// Ignore
-				log.Printf("Ignoring task completion in phase %d: host %v; number: %v\n", n.Phase, task.Addr, task.Number)
+				logger.Info("ignoring task completion", "current_phase", n.Phase.String())
 			}
 			currPhase = n.Phase
 		})
+		if canceled {
+			return nil, nil, errCanceled
+		}
+		if failed != nil {
+			return nil, nil, failed
+		}
 		// End this loop outside the closure
 		if currPhase >= Merge {
 			break
 		}
 	}
 
-	return reduceHosts
+	return mapResults, reduceResults, nil
 }
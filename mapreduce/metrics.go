@@ -0,0 +1,174 @@
+package mapreduce
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type (
+	// A family of counters distinguished by label values
+	counterVec struct {
+		name, help string
+		labels     []string
+		mu         sync.Mutex
+		values     map[string]float64 // Keyed by the rendered label set
+	}
+
+	// A family of histograms distinguished by label values
+	histogramVec struct {
+		name, help string
+		labels     []string
+		buckets    []float64 // Upper bounds, ascending
+		mu         sync.Mutex
+		series     map[string]*histogram // Keyed by the rendered label set
+	}
+
+	histogram struct {
+		counts []uint64 // Per bucket (not cumulative), plus one for +Inf
+		sum    float64
+		count  uint64
+	}
+
+	// Anything that can write itself in the Prometheus text exposition format
+	metric interface {
+		write(w io.Writer)
+	}
+)
+
+var (
+	durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+	tasksAssigned     = newCounterVec("mapreduce_tasks_assigned_total", "Tasks assigned to workers by the master.", "phase")
+	tasksCompleted    = newCounterVec("mapreduce_tasks_completed_total", "Tasks completed.", "phase")
+	tasksFailed       = newCounterVec("mapreduce_tasks_failed_total", "Tasks that failed on a worker.", "phase")
+	mapInputPairs     = newCounterVec("mapreduce_map_input_pairs_total", "Pairs read by map tasks.")
+	mapOutputPairs    = newCounterVec("mapreduce_map_output_pairs_total", "Pairs generated by map tasks.")
+	reduceKeys        = newCounterVec("mapreduce_reduce_keys_total", "Keys processed by reduce tasks.")
+	reduceValues      = newCounterVec("mapreduce_reduce_values_total", "Values processed by reduce tasks.")
+	reduceOutput      = newCounterVec("mapreduce_reduce_output_pairs_total", "Pairs generated by reduce tasks.")
+	bytesDownloaded   = newCounterVec("mapreduce_downloaded_bytes_total", "Bytes received over HTTP (as transferred, possibly compressed).")
+	taskDuration      = newHistogramVec("mapreduce_task_duration_seconds", "Time spent processing tasks on a worker.", durationBuckets, "phase")
+	rpcDuration       = newHistogramVec("mapreduce_rpc_duration_seconds", "Latency of outgoing RPC calls.", durationBuckets, "method")
+	registeredMetrics = []metric{tasksAssigned, tasksCompleted, tasksFailed, mapInputPairs, mapOutputPairs, reduceKeys, reduceValues, reduceOutput, bytesDownloaded, taskDuration, rpcDuration}
+)
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+// Adds v to the counter with the given label values
+func (c *counterVec) add(v float64, labelValues ...string) {
+	key := labelSet(c.labels, labelValues)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+// Records an observation in the histogram with the given label values
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := labelSet(h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	s.counts[i]++
+	s.sum += v
+	s.count++
+}
+
+func (c *counterVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatValue(c.values[key]))
+	}
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, count := range s.counts {
+			bound := math.Inf(1)
+			if i < len(h.buckets) {
+				bound = h.buckets[i]
+			}
+			cumulative += count
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(key, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, s.count)
+	}
+}
+
+// Serves all metrics in the Prometheus text exposition format
+func metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, m := range registeredMetrics {
+			m.write(w)
+		}
+	})
+}
+
+// Renders label names and values as {a="x",b="y"} (empty without labels)
+func labelSet(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = name + "=" + strconv.Quote(value)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Appends a label to a rendered label set
+func withLabel(set, name, value string) string {
+	label := name + "=" + strconv.Quote(value)
+	if set == "" {
+		return "{" + label + "}"
+	}
+	return set[:len(set)-1] + "," + label + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,537 @@
+// Package mrtest runs a master and workers in one process on ephemeral ports, with injected failures,
+// and checks the output of the job against a local run.
+package mrtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/evad1n/mapreduce/mapreduce"
+)
+
+// AnyWorker makes KillWorker kill whichever worker first maps (or reduces) the key
+const AnyWorker = -1
+
+// ErrKilled is what Result.Workers holds for workers taken down by KillWorker
+var ErrKilled = errors.New("worker killed")
+
+type (
+	// Options configures a simulated cluster
+	Options struct {
+		Dir          string            // Holds the nodes' temp dirs and the output, a fresh temporary directory if empty
+		Input        string            // Input db
+		Workers      int               // Defaults to 3
+		M, R         int               // Default to 6 and 3
+		MapOnly      bool              // Runs a map-only job (R=0)
+		Stages       []mapreduce.Stage // Runs a pipeline instead of a job of the client, M applies to its first stage
+		Compression  string            // Defaults to no compression
+		CacheFiles   []string          // Served to every task, see mapreduce.TaskContext.CacheFile
+		StuckTimeout time.Duration     // Defaults to 500ms, so tasks of failed workers get backed up quickly
+		Timeout      time.Duration     // Defaults to 30s
+		Faults       []Fault
+		Logger       *slog.Logger // Defaults to discarding logs
+	}
+
+	// Result of a job run by a simulated cluster
+	Result struct {
+		Output  []mapreduce.Pair            // Sorted by key, then value
+		Sides   map[string][]mapreduce.Pair // Side outputs by name, each sorted like Output
+		Report  mapreduce.Report
+		Workers []error // What each worker's Run returned
+	}
+
+	// Fault is a failure injected into a simulated cluster
+	Fault interface {
+		inject(c *cluster)
+	}
+
+	// KillWorker takes a worker off the network when its Map is called with Key (any key if empty),
+	// as if the machine died mid-task. Its files can no longer be downloaded. Worker can be AnyWorker.
+	KillWorker struct {
+		Worker int
+		Key    string
+		Reduce bool // Kills on a Reduce call with Key instead, once the worker's map outputs are needed
+	}
+
+	// DelayRPC delays every RPC call a worker makes
+	DelayRPC struct {
+		Worker int
+		Delay  time.Duration
+	}
+
+	// CorruptDownloads flips the first byte of the first Count files a worker downloads
+	CorruptDownloads struct {
+		Worker int
+		Count  int
+	}
+
+	// DropDownloads cuts the first Count transfers of a worker off halfway
+	DropDownloads struct {
+		Worker int
+		Count  int
+	}
+
+	// PanicOnKey makes Map panic on Key, the first Count times it is called with it across the cluster.
+	// Workers report the failed task to the master and go on with other tasks, serving the files they
+	// already produced.
+	PanicOnKey struct {
+		Key   string
+		Count int
+	}
+
+	// A simulated cluster
+	cluster struct {
+		opts    Options
+		workers []*node
+		panics  map[string]int     // Panics left per key
+		kills   map[killPoint]bool // Keys that kill the first worker mapping or reducing them
+		mu      sync.Mutex
+	}
+
+	// A key whose Map or Reduce kills a worker
+	killPoint struct {
+		key    string
+		reduce bool
+	}
+
+	// A node of a simulated cluster
+	node struct {
+		listener  net.Listener
+		transport *http.Transport
+		killed    atomic.Bool
+		killAt    *killPoint // Call that kills the node, nil for none
+		delay     time.Duration
+		corrupt   atomic.Int64 // Downloads left to corrupt
+		drop      atomic.Int64 // Transfers left to drop
+	}
+
+	// Passes calls on to the client, injecting the faults of a worker
+	faultyClient struct {
+		client mapreduce.Interface
+		c      *cluster
+		n      *node
+	}
+
+	// Injects the download faults of a node
+	faultyTransport struct {
+		n *node
+	}
+
+	// Fails reads after limit bytes
+	droppedBody struct {
+		io.ReadCloser
+		limit int64
+	}
+
+	// Flips the first byte read
+	corruptBody struct {
+		io.ReadCloser
+		done bool
+	}
+)
+
+func (f KillWorker) inject(c *cluster) {
+	point := killPoint{key: f.Key, reduce: f.Reduce}
+	if f.Worker == AnyWorker {
+		c.kills[point] = true
+		return
+	}
+	c.workers[f.Worker].killAt = &point
+}
+
+func (f DelayRPC) inject(c *cluster) {
+	c.workers[f.Worker].delay = f.Delay
+}
+
+func (f CorruptDownloads) inject(c *cluster) {
+	c.workers[f.Worker].corrupt.Add(int64(f.Count))
+}
+
+func (f DropDownloads) inject(c *cluster) {
+	c.workers[f.Worker].drop.Add(int64(f.Count))
+}
+
+func (f PanicOnKey) inject(c *cluster) {
+	c.panics[f.Key] += f.Count
+}
+
+// Run runs a job on a master and opts.Workers workers in this process
+func Run(opts Options, client mapreduce.Interface) (*Result, error) {
+	opts, cleanup, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	c := &cluster{opts: opts, panics: make(map[string]int), kills: make(map[killPoint]bool)}
+	master, err := newNode()
+	if err != nil {
+		return nil, err
+	}
+	defer master.close()
+	for i := 0; i < opts.Workers; i++ {
+		n, err := newNode()
+		if err != nil {
+			return nil, err
+		}
+		defer n.close()
+		c.workers = append(c.workers, n)
+	}
+	for _, f := range opts.Faults {
+		f.inject(c)
+	}
+
+	cfg := mapreduce.Config{
+		Master:       true,
+		Host:         master.listener.Addr().String(),
+		Tempdir:      filepath.Join(opts.Dir, "master"),
+		M:            opts.M,
+		R:            opts.R,
+		InputPath:    opts.Input,
+		OutputPath:   filepath.Join(opts.Dir, "output.db"),
+		StuckTimeout: opts.StuckTimeout,
+		Compression:  opts.Compression,
+		CacheFiles:   opts.CacheFiles,
+		Logger:       opts.Logger.With("node", "master"),
+	}
+	master.configure(&cfg)
+	masterDone := make(chan error, 1)
+	go func() {
+		masterDone <- mapreduce.RunPipeline(cfg, opts.stages(client))
+	}()
+
+	result := &Result{Workers: make([]error, opts.Workers)}
+	var wg sync.WaitGroup
+	for i, n := range c.workers {
+		wcfg := mapreduce.Config{
+			MasterAddr:  cfg.Host,
+			Host:        n.listener.Addr().String(),
+			Tempdir:     filepath.Join(opts.Dir, fmt.Sprintf("worker%d", i)),
+			Compression: opts.Compression,
+			Logger:      opts.Logger.With("node", fmt.Sprintf("worker%d", i)),
+		}
+		n.configure(&wcfg)
+		wg.Add(1)
+		go func(i int, n *node) {
+			defer wg.Done()
+			stages := opts.stages(client)
+			for s := range stages {
+				stages[s].Client = faultyClient{stages[s].Client, c, n}
+			}
+			err := mapreduce.RunPipeline(wcfg, stages)
+			if n.killed.Load() {
+				err = ErrKilled
+			}
+			result.Workers[i] = err
+		}(i, n)
+	}
+
+	timeout := time.After(opts.Timeout)
+	select {
+	case err := <-masterDone:
+		if err != nil {
+			return nil, fmt.Errorf("master: %v", err)
+		}
+	case <-timeout:
+		return nil, fmt.Errorf("job did not finish within %v", opts.Timeout)
+	}
+	workersDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(workersDone)
+	}()
+	select {
+	case <-workersDone:
+	case <-timeout:
+		return nil, fmt.Errorf("workers did not shut down within %v", opts.Timeout)
+	}
+
+	if result.Output, err = mapreduce.ReadOutput(cfg.OutputPath); err != nil {
+		return nil, err
+	}
+	if result.Sides, err = mapreduce.ReadSideOutputs(cfg.OutputPath); err != nil {
+		return nil, err
+	}
+	report, err := os.ReadFile(cfg.OutputPath + ".report.json")
+	if err != nil {
+		return nil, fmt.Errorf("reading report: %v", err)
+	}
+	if err := json.Unmarshal(report, &result.Report); err != nil {
+		return nil, fmt.Errorf("parsing report: %v", err)
+	}
+	return result, nil
+}
+
+// Reference runs the job of opts with mapreduce.RunLocalPipeline, without faults
+func Reference(opts Options, client mapreduce.Interface) ([]mapreduce.Pair, error) {
+	result, err := reference(opts, client)
+	if err != nil {
+		return nil, err
+	}
+	return result.Output, nil
+}
+
+func reference(opts Options, client mapreduce.Interface) (*mapreduce.LocalResult, error) {
+	opts, cleanup, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	result, err := mapreduce.RunLocalPipeline(mapreduce.Config{
+		Tempdir:     filepath.Join(opts.Dir, "local"),
+		M:           opts.M,
+		InputPath:   opts.Input,
+		Compression: opts.Compression,
+		CacheFiles:  opts.CacheFiles,
+		Logger:      opts.Logger.With("node", "local"),
+	}, opts.stages(client))
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Check runs the job on a simulated cluster and fails the test if its output (or a side output) differs from a
+// local run
+func Check(t testing.TB, opts Options, client mapreduce.Interface) *Result {
+	t.Helper()
+	want, err := reference(opts, client)
+	if err != nil {
+		t.Fatalf("local run: %v", err)
+	}
+	result, err := Run(opts, client)
+	if err != nil {
+		t.Fatalf("cluster run: %v", err)
+	}
+	if !slices.Equal(result.Output, want.Output) {
+		t.Fatalf("cluster output differs from local run: %s", diff(result.Output, want.Output))
+	}
+	if len(result.Sides) != len(want.Sides) {
+		t.Fatalf("cluster run has %d side outputs, local run %d", len(result.Sides), len(want.Sides))
+	}
+	for name, pairs := range want.Sides {
+		if !slices.Equal(result.Sides[name], pairs) {
+			t.Fatalf("cluster side output %s differs from local run: %s", name, diff(result.Sides[name], pairs))
+		}
+	}
+	return result
+}
+
+// Describes the first difference between two outputs
+func diff(got, want []mapreduce.Pair) string {
+	for i := 0; i < len(got) && i < len(want); i++ {
+		if got[i] != want[i] {
+			return fmt.Sprintf("pair %d is %v, want %v", i, got[i], want[i])
+		}
+	}
+	return fmt.Sprintf("got %d pairs, want %d", len(got), len(want))
+}
+
+// Returns a copy of the pipeline of opts, or the single stage running client
+func (opts Options) stages(client mapreduce.Interface) []mapreduce.Stage {
+	if len(opts.Stages) > 0 {
+		return slices.Clone(opts.Stages)
+	}
+	return []mapreduce.Stage{{Client: client, R: opts.R}}
+}
+
+// Fills in defaults, returning a function that removes the temporary directory if one was created
+func (opts Options) withDefaults() (Options, func(), error) {
+	cleanup := func() {}
+	if opts.Dir == "" {
+		dir, err := os.MkdirTemp("", "mrtest")
+		if err != nil {
+			return opts, cleanup, fmt.Errorf("creating temp dir: %v", err)
+		}
+		opts.Dir = dir
+		cleanup = func() { os.RemoveAll(dir) }
+	}
+	if opts.Workers == 0 {
+		opts.Workers = 3
+	}
+	if opts.M == 0 {
+		opts.M = 6
+	}
+	if opts.MapOnly {
+		opts.R = 0
+	} else if opts.R == 0 {
+		opts.R = 3
+	}
+	if opts.Compression == "" {
+		opts.Compression = mapreduce.NoCompression
+	}
+	if opts.StuckTimeout == 0 {
+		opts.StuckTimeout = 500 * time.Millisecond
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 30 * time.Second
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	return opts, cleanup, nil
+}
+
+func newNode() (*node, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("listening: %v", err)
+	}
+	n := &node{listener: ln}
+	n.transport = &http.Transport{
+		DialContext: func(_ context.Context, network, addr string) (net.Conn, error) {
+			return n.dial(network, addr)
+		},
+	}
+	return n, nil
+}
+
+// Points the node's network hooks at the simulation
+func (n *node) configure(cfg *mapreduce.Config) {
+	cfg.Listener = n.listener
+	cfg.Dial = func(network, addr string) (net.Conn, error) {
+		time.Sleep(n.delay)
+		return n.dial(network, addr)
+	}
+	cfg.Transport = faultyTransport{n}
+}
+
+func (n *node) dial(network, addr string) (net.Conn, error) {
+	if n.killed.Load() {
+		return nil, ErrKilled
+	}
+	return net.Dial(network, addr)
+}
+
+// Cuts the node off the network
+func (n *node) kill() {
+	n.killed.Store(true)
+	n.close()
+}
+
+func (n *node) close() {
+	n.listener.Close()
+	n.transport.CloseIdleConnections()
+}
+
+func (t faultyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.n.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if t.n.drop.Add(-1) >= 0 {
+		limit := resp.ContentLength / 2
+		if limit < 1 {
+			limit = 1
+		}
+		resp.Body = &droppedBody{resp.Body, limit}
+	} else if t.n.corrupt.Add(-1) >= 0 {
+		resp.Body = &corruptBody{ReadCloser: resp.Body}
+	}
+	return resp, nil
+}
+
+func (b *droppedBody) Read(p []byte) (int, error) {
+	if b.limit <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > b.limit {
+		p = p[:b.limit]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.limit -= int64(n)
+	return n, err
+}
+
+func (b *corruptBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.done {
+		p[0] ^= 0xff
+		b.done = true
+	}
+	return n, err
+}
+
+// Returns whether mapping (or reducing) key kills a worker
+func (c *cluster) killOn(n *node, key string, reduce bool) bool {
+	if p := n.killAt; p != nil && p.reduce == reduce && (p.key == "" || p.key == key) {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range []string{key, ""} {
+		if p := (killPoint{key: k, reduce: reduce}); c.kills[p] {
+			delete(c.kills, p)
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether Map should panic on key, using up one of the key's panics
+func (c *cluster) panicOn(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.panics[key] > 0 {
+		c.panics[key]--
+		return true
+	}
+	return false
+}
+
+func (f faultyClient) MapWithContext(ctx *mapreduce.TaskContext, key, value string, output chan<- mapreduce.Pair) error {
+	if f.c.killOn(f.n, key, false) {
+		f.n.kill()
+		close(output)
+		return ErrKilled
+	}
+	if f.c.panicOn(key) {
+		close(output)
+		panic(fmt.Sprintf("injected panic on key %q", key))
+	}
+	if mapper, ok := f.client.(mapreduce.ContextMapper); ok {
+		return mapper.MapWithContext(ctx, key, value, output)
+	}
+	return f.client.Map(key, value, output)
+}
+
+func (f faultyClient) ReduceWithContext(ctx *mapreduce.TaskContext, key string, values <-chan string, output chan<- mapreduce.Pair) error {
+	if f.c.killOn(f.n, key, true) {
+		f.n.kill()
+		for range values {
+		}
+		close(output)
+		return ErrKilled
+	}
+	if reducer, ok := f.client.(mapreduce.ContextReducer); ok {
+		return reducer.ReduceWithContext(ctx, key, values, output)
+	}
+	return f.client.Reduce(key, values, output)
+}
+
+func (f faultyClient) Map(key, value string, output chan<- mapreduce.Pair) error {
+	return f.client.Map(key, value, output)
+}
+
+func (f faultyClient) Reduce(key string, values <-chan string, output chan<- mapreduce.Pair) error {
+	return f.client.Reduce(key, values, output)
+}
+
+// Lets the library find the optional hooks of the client, such as its comparators
+func (f faultyClient) Unwrap() mapreduce.Interface {
+	return f.client
+}
@@ -0,0 +1,555 @@
+package mrtest
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evad1n/mapreduce/mapreduce"
+)
+
+type wordCount struct{}
+
+func (wordCount) Map(key, value string, output chan<- mapreduce.Pair) error {
+	defer close(output)
+	for _, word := range strings.Fields(value) {
+		output <- mapreduce.Pair{Key: word, Value: "1"}
+	}
+	return nil
+}
+
+func (wordCount) Reduce(key string, values <-chan string, output chan<- mapreduce.Pair) error {
+	defer close(output)
+	count := 0
+	for v := range values {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		count += i
+	}
+	output <- mapreduce.Pair{Key: key, Value: strconv.Itoa(count)}
+	return nil
+}
+
+// Writes an input db of numbered lines of words
+func writeInput(t *testing.T) string {
+	t.Helper()
+	words := []string{"the", "quick", "brown", "fox", "jumps", "over", "lazy", "dog", "emma", "darcy"}
+	pairs := make([]mapreduce.Pair, 600)
+	for i := range pairs {
+		var line []string
+		for j := 0; j < 8; j++ {
+			line = append(line, words[(i*7+j*3)%len(words)])
+		}
+		pairs[i] = mapreduce.Pair{Key: strconv.Itoa(i), Value: strings.Join(line, " ")}
+	}
+	path := filepath.Join(t.TempDir(), "input.db")
+	if err := mapreduce.WriteInput(path, pairs); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCluster(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression string
+		mapOnly     bool
+		faults      []Fault
+	}{
+		{name: "no faults"},
+		{name: "gzip", compression: mapreduce.GzipCompression},
+		{name: "kill worker", faults: []Fault{KillWorker{Worker: 0}}},
+		{name: "delay rpc", faults: []Fault{DelayRPC{Worker: 1, Delay: 50 * time.Millisecond}}},
+		{name: "corrupt downloads", faults: []Fault{CorruptDownloads{Worker: 0, Count: 2}, CorruptDownloads{Worker: 2, Count: 1}}},
+		{name: "drop downloads", faults: []Fault{DropDownloads{Worker: 1, Count: 3}}},
+		{name: "drop gzip downloads", compression: mapreduce.GzipCompression, faults: []Fault{DropDownloads{Worker: 1, Count: 3}}},
+		{name: "map panics", faults: []Fault{PanicOnKey{Key: "17", Count: 1}}},
+		{name: "map only", mapOnly: true},
+		{name: "map only with faults", mapOnly: true, faults: []Fault{KillWorker{Worker: 2}, CorruptDownloads{Worker: 0, Count: 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := Options{
+				Dir:         t.TempDir(),
+				Input:       writeInput(t),
+				Compression: tt.compression,
+				MapOnly:     tt.mapOnly,
+				Faults:      tt.faults,
+			}
+			result := Check(t, opts, wordCount{})
+			if !result.Report.Success {
+				t.Errorf("report says the job failed: %s", result.Report.Error)
+			}
+		})
+	}
+}
+
+func TestKilledWorkerTaskIsRetried(t *testing.T) {
+	opts := Options{
+		Dir:    t.TempDir(),
+		Input:  writeInput(t),
+		Faults: []Fault{KillWorker{Worker: AnyWorker, Key: "0"}},
+	}
+	result := Check(t, opts, wordCount{})
+
+	killed := 0
+	for _, err := range result.Workers {
+		if errors.Is(err, ErrKilled) {
+			killed++
+		}
+	}
+	if killed != 1 {
+		t.Errorf("%d workers were killed, want 1", killed)
+	}
+	// Map task 0 holds key 0, so it took a second attempt
+	if attempts := result.Report.MapTasks[0].Attempts; attempts < 2 {
+		t.Errorf("map task 0 took %d attempts, want at least 2", attempts)
+	}
+}
+
+func TestPanicFailsOnlyTheTask(t *testing.T) {
+	// Key 599 is in the last map task, after the worker served the files of earlier ones
+	for _, key := range []string{"0", "599"} {
+		t.Run(key, func(t *testing.T) {
+			opts := Options{
+				Dir:    t.TempDir(),
+				Input:  writeInput(t),
+				Faults: []Fault{PanicOnKey{Key: key, Count: 1}},
+			}
+			result := Check(t, opts, wordCount{})
+
+			for i, err := range result.Workers {
+				if err != nil {
+					t.Errorf("worker %d returned %v, want it to keep running", i, err)
+				}
+			}
+			var failures []mapreduce.FailedAttempt
+			for _, task := range result.Report.MapTasks {
+				failures = append(failures, task.Failures...)
+			}
+			want := fmt.Sprintf("map panicked on key %q", key)
+			if len(failures) != 1 || !strings.Contains(failures[0].Error, want) {
+				t.Errorf("report lists failures %v, want the injected panic", failures)
+			}
+		})
+	}
+}
+
+func TestWorkerKilledInReduce(t *testing.T) {
+	opts := Options{
+		Dir:    t.TempDir(),
+		Input:  writeInput(t),
+		M:      12,
+		Faults: []Fault{KillWorker{Worker: AnyWorker, Key: "the", Reduce: true}},
+	}
+	result := Check(t, opts, wordCount{})
+
+	killed := 0
+	for i, err := range result.Workers {
+		switch {
+		case errors.Is(err, ErrKilled):
+			killed++
+		case err != nil:
+			t.Errorf("worker %d returned %v", i, err)
+		}
+	}
+	if killed != 1 {
+		t.Errorf("%d workers were killed, want 1", killed)
+	}
+	if !result.Report.Success {
+		t.Errorf("report says the job failed: %s", result.Report.Error)
+	}
+}
+
+// Groups the words of a word count by their count
+type invert struct{}
+
+func (invert) Map(key, value string, output chan<- mapreduce.Pair) error {
+	defer close(output)
+	output <- mapreduce.Pair{Key: value, Value: key}
+	return nil
+}
+
+func (invert) Reduce(key string, values <-chan string, output chan<- mapreduce.Pair) error {
+	defer close(output)
+	var words []string
+	for v := range values {
+		words = append(words, v)
+	}
+	slices.Sort(words)
+	output <- mapreduce.Pair{Key: key, Value: strings.Join(words, ",")}
+	return nil
+}
+
+// Passes pairs through a map-only stage
+type identity struct{}
+
+func (identity) Map(key, value string, output chan<- mapreduce.Pair) error {
+	defer close(output)
+	output <- mapreduce.Pair{Key: key, Value: value}
+	return nil
+}
+
+func (identity) Reduce(key string, values <-chan string, output chan<- mapreduce.Pair) error {
+	return errors.New("identity is map-only")
+}
+
+func TestPipeline(t *testing.T) {
+	opts := Options{
+		Dir:   t.TempDir(),
+		Input: writeInput(t),
+		Stages: []mapreduce.Stage{
+			{Name: "count", Client: wordCount{}, R: 3},
+			{Name: "invert", Client: invert{}, R: 2},
+			{Name: "both", Client: identity{}, Inputs: []string{"count", "invert"}},
+		},
+		Faults: []Fault{DropDownloads{Worker: 1, Count: 2}},
+	}
+	result := Check(t, opts, nil)
+
+	// The last stage read both the word counts and the words grouped by count
+	words, groups := 0, 0
+	for _, pair := range result.Output {
+		if _, err := strconv.Atoi(pair.Key); err == nil {
+			groups++
+		} else {
+			words++
+		}
+	}
+	if words != 10 || groups == 0 {
+		t.Errorf("output has %d word counts and %d groups, want 10 and at least 1", words, groups)
+	}
+	stages := make(map[string]int)
+	for _, task := range result.Report.MapTasks {
+		stages[task.Stage]++
+	}
+	// One map task per input shard, then one per output file of the stages read
+	if want := map[string]int{"count": 6, "invert": 3, "both": 5}; !maps.Equal(stages, want) {
+		t.Errorf("map tasks per stage are %v, want %v", stages, want)
+	}
+}
+
+// Halves numbers in a map-only stage, counting those not yet zero
+type halve struct{ identity }
+
+func (halve) MapWithContext(ctx *mapreduce.TaskContext, key, value string, output chan<- mapreduce.Pair) error {
+	defer close(output)
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	if n /= 2; n > 0 {
+		ctx.Count("nonzero", 1)
+	}
+	output <- mapreduce.Pair{Key: key, Value: strconv.Itoa(n)}
+	return nil
+}
+
+func TestIterativeJob(t *testing.T) {
+	pairs := make([]mapreduce.Pair, 100)
+	for i := range pairs {
+		pairs[i] = mapreduce.Pair{Key: strconv.Itoa(i), Value: strconv.Itoa(i)}
+	}
+	input := filepath.Join(t.TempDir(), "input.db")
+	if err := mapreduce.WriteInput(input, pairs); err != nil {
+		t.Fatal(err)
+	}
+
+	job := mapreduce.IterativeJob{
+		Client:        halve{},
+		MaxIterations: 20,
+		Converged: func(it *mapreduce.Iteration) (bool, error) {
+			return it.Counters["nonzero"] == 0, nil
+		},
+	}
+	opts := Options{Dir: t.TempDir(), Input: input, Stages: job.Stages()}
+	result := Check(t, opts, nil)
+
+	// 99 takes 7 halvings to reach zero
+	stages := make(map[string]bool)
+	for _, task := range result.Report.MapTasks {
+		stages[task.Stage] = true
+	}
+	if len(stages) != 7 {
+		t.Errorf("ran %d iterations, want 7", len(stages))
+	}
+	for _, pair := range result.Output {
+		if pair.Value != "0" {
+			t.Errorf("got %v, want every value halved to 0", pair)
+		}
+	}
+}
+
+// Lists each user's events in time order, with keys like user|time and events as values
+type timeline struct{}
+
+func splitKey(key string) (string, int) {
+	user, t, _ := strings.Cut(key, "|")
+	n, _ := strconv.Atoi(t)
+	return user, n
+}
+
+func (timeline) Map(key, value string, output chan<- mapreduce.Pair) error {
+	defer close(output)
+	user, event, _ := strings.Cut(value, " ")
+	output <- mapreduce.Pair{Key: user + "|" + key, Value: event}
+	return nil
+}
+
+func (timeline) Reduce(key string, values <-chan string, output chan<- mapreduce.Pair) error {
+	defer close(output)
+	var events []string
+	for v := range values {
+		events = append(events, v)
+	}
+	user, _ := splitKey(key)
+	output <- mapreduce.Pair{Key: user, Value: strings.Join(events, ",")}
+	return nil
+}
+
+// Orders by user, then numerically by time, which differs from the default text order
+func (timeline) SortCompare(a, b mapreduce.Pair) int {
+	userA, timeA := splitKey(a.Key)
+	userB, timeB := splitKey(b.Key)
+	if c := strings.Compare(userA, userB); c != 0 {
+		return c
+	}
+	return timeA - timeB
+}
+
+func (timeline) GroupCompare(a, b string) int {
+	userA, _ := splitKey(a)
+	userB, _ := splitKey(b)
+	return strings.Compare(userA, userB)
+}
+
+func (timeline) Partition(key string, r int) int {
+	user, _ := splitKey(key)
+	return int(user[0]) % r
+}
+
+func TestSecondarySortAndGrouping(t *testing.T) {
+	// Event i of user u happens at time 100-i*7, so the text order of the times is neither the
+	// input order nor the time order
+	var pairs []mapreduce.Pair
+	for i := 0; i < 15; i++ {
+		for _, user := range []string{"ann", "bob", "cy"} {
+			pairs = append(pairs, mapreduce.Pair{Key: strconv.Itoa(100 - i*7), Value: fmt.Sprintf("%s e%d", user, i)})
+		}
+	}
+	input := filepath.Join(t.TempDir(), "input.db")
+	if err := mapreduce.WriteInput(input, pairs); err != nil {
+		t.Fatal(err)
+	}
+
+	result := Check(t, Options{Dir: t.TempDir(), Input: input}, timeline{})
+
+	var want []string
+	for i := 14; i >= 0; i-- {
+		want = append(want, fmt.Sprintf("e%d", i))
+	}
+	if len(result.Output) != 3 {
+		t.Fatalf("got %v, want one row per user", result.Output)
+	}
+	for _, pair := range result.Output {
+		if pair.Value != strings.Join(want, ",") {
+			t.Errorf("events of %s are %s, want %s", pair.Key, pair.Value, strings.Join(want, ","))
+		}
+	}
+}
+
+// Word count that sums counts in memory and emits them when each map task ends, and marks the end of each reduce task
+type combiningWordCount struct{ wordCount }
+
+func (combiningWordCount) MapSetup(ctx *mapreduce.TaskContext) error {
+	ctx.State = make(map[string]int)
+	return nil
+}
+
+func (combiningWordCount) MapWithContext(ctx *mapreduce.TaskContext, key, value string, output chan<- mapreduce.Pair) error {
+	defer close(output)
+	counts := ctx.State.(map[string]int)
+	for _, word := range strings.Fields(value) {
+		counts[word]++
+	}
+	return nil
+}
+
+func (combiningWordCount) MapCleanup(ctx *mapreduce.TaskContext, output chan<- mapreduce.Pair) error {
+	defer close(output)
+	for word, count := range ctx.State.(map[string]int) {
+		output <- mapreduce.Pair{Key: word, Value: strconv.Itoa(count)}
+	}
+	return nil
+}
+
+func (combiningWordCount) ReduceCleanup(ctx *mapreduce.TaskContext, output chan<- mapreduce.Pair) error {
+	defer close(output)
+	output <- mapreduce.Pair{Key: "~end", Value: strconv.Itoa(ctx.Number)}
+	return nil
+}
+
+func TestSetupAndCleanup(t *testing.T) {
+	opts := Options{Dir: t.TempDir(), Input: writeInput(t)}
+	result := Check(t, opts, combiningWordCount{})
+
+	want, err := Reference(opts, wordCount{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One end marker per reduce task after the word counts
+	if len(result.Output) != len(want)+3 {
+		t.Fatalf("got %d pairs, want %d word counts and 3 end markers", len(result.Output), len(want))
+	}
+	for i, pair := range result.Output[len(want):] {
+		if pair != (mapreduce.Pair{Key: "~end", Value: strconv.Itoa(i)}) {
+			t.Errorf("got %v, want the end marker of reduce task %d", pair, i)
+		}
+	}
+	if got := result.Output[:len(want)]; !slices.Equal(got, want) {
+		t.Errorf("combined counts differ from word count: %s", diff(got, want))
+	}
+	// Each map task emits every word at most once
+	if got, max := result.Report.Totals.MapOutputPairs, 6*10; got > max {
+		t.Errorf("map tasks emitted %d pairs, want at most %d", got, max)
+	}
+}
+
+// Word count that sends lines mentioning fox to an errors output and the keys of each reduce task to a stats output
+type sideWordCount struct{ wordCount }
+
+func (c sideWordCount) MapWithContext(ctx *mapreduce.TaskContext, key, value string, output chan<- mapreduce.Pair) error {
+	if strings.Contains(" "+value+" ", " fox ") {
+		if err := ctx.Emit("errors", mapreduce.Pair{Key: key, Value: "fox"}); err != nil {
+			close(output)
+			return err
+		}
+	}
+	return c.Map(key, value, output)
+}
+
+func (sideWordCount) ReduceSetup(ctx *mapreduce.TaskContext) error {
+	ctx.State = new(int)
+	return nil
+}
+
+func (c sideWordCount) ReduceWithContext(ctx *mapreduce.TaskContext, key string, values <-chan string, output chan<- mapreduce.Pair) error {
+	*ctx.State.(*int)++
+	return c.Reduce(key, values, output)
+}
+
+func (sideWordCount) ReduceCleanup(ctx *mapreduce.TaskContext, output chan<- mapreduce.Pair) error {
+	defer close(output)
+	return ctx.Emit("stats", mapreduce.Pair{Key: strconv.Itoa(ctx.Number), Value: strconv.Itoa(*ctx.State.(*int))})
+}
+
+func TestSideOutputs(t *testing.T) {
+	opts := Options{Dir: t.TempDir(), Input: writeInput(t)}
+	result := Check(t, opts, sideWordCount{})
+
+	want, err := Reference(opts, wordCount{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(result.Output, want) {
+		t.Errorf("main output differs from word count: %s", diff(result.Output, want))
+	}
+	if n := len(result.Sides["errors"]); n == 0 || n >= 600 {
+		t.Errorf("errors output has %d rows, want some of the 600 lines", n)
+	}
+	keys := 0
+	for _, pair := range result.Sides["stats"] {
+		n, _ := strconv.Atoi(pair.Value)
+		keys += n
+	}
+	if len(result.Sides["stats"]) != 3 || keys != len(want) {
+		t.Errorf("stats output is %v, want the keys of the 3 reduce tasks adding up to %d", result.Sides["stats"], len(want))
+	}
+	if result.Report.Totals.SidePairs != len(result.Sides["errors"])+3 {
+		t.Errorf("report counts %d side pairs, want %d", result.Report.Totals.SidePairs, len(result.Sides["errors"])+3)
+	}
+}
+
+// Word count in French, translating words through a cached dictionary db and skipping the stop words of a
+// cached text file
+type translatedWordCount struct{ wordCount }
+
+func (translatedWordCount) MapSetup(ctx *mapreduce.TaskContext) error {
+	path, err := ctx.CacheFile("stopwords.txt")
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	stop := make(map[string]bool)
+	for _, word := range strings.Fields(string(data)) {
+		stop[word] = true
+	}
+	ctx.State = stop
+	return nil
+}
+
+func (translatedWordCount) MapWithContext(ctx *mapreduce.TaskContext, key, value string, output chan<- mapreduce.Pair) error {
+	defer close(output)
+	for _, word := range strings.Fields(value) {
+		if ctx.State.(map[string]bool)[word] {
+			continue
+		}
+		translations, err := ctx.Lookup("dictionary.db", word)
+		if err != nil {
+			return err
+		}
+		if len(translations) > 0 {
+			word = translations[0]
+		}
+		output <- mapreduce.Pair{Key: word, Value: "1"}
+	}
+	return nil
+}
+
+func TestCacheFiles(t *testing.T) {
+	dir := t.TempDir()
+	dictionary := filepath.Join(dir, "dictionary.db")
+	err := mapreduce.WriteInput(dictionary, []mapreduce.Pair{{Key: "fox", Value: "renard"}, {Key: "dog", Value: "chien"}, {Key: "quick", Value: "rapide"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopwords := filepath.Join(dir, "stopwords.txt")
+	if err := os.WriteFile(stopwords, []byte("the\nover\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := Options{
+		Dir:         t.TempDir(),
+		Input:       writeInput(t),
+		Compression: mapreduce.GzipCompression,
+		CacheFiles:  []string{dictionary, stopwords},
+		Faults:      []Fault{CorruptDownloads{Worker: 1, Count: 1}},
+	}
+	result := Check(t, opts, translatedWordCount{})
+	words := make(map[string]bool)
+	for _, pair := range result.Output {
+		words[pair.Key] = true
+	}
+	for _, word := range []string{"renard", "chien", "rapide", "emma"} {
+		if !words[word] {
+			t.Errorf("output lacks %q: %v", word, result.Output)
+		}
+	}
+	for _, word := range []string{"fox", "the", "over"} {
+		if words[word] {
+			t.Errorf("output has %q: %v", word, result.Output)
+		}
+	}
+}
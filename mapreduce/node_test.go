@@ -0,0 +1,535 @@
+package mapreduce
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Starts a master node in the map phase of a job with m map and r reduce tasks
+func newTestNode(t *testing.T, m, r int) NodeActor {
+	t.Helper()
+	cfg := &Config{JobID: "job", Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	n := &Node{
+		Done:    make(chan JobDone, 10),
+		wake:    make(chan struct{}, 1),
+		Workers: make(map[string]*WorkerInfo),
+		cfg:     cfg,
+	}
+	actor := n.startActor()
+
+	mapTasks := make([]MapTask, m)
+	for i := range mapTasks {
+		mapTasks[i] = MapTask{M: m, R: r, N: i, Job: cfg.JobID}
+	}
+	reduceTasks := make([]ReduceTask, r)
+	for i := range reduceTasks {
+		reduceTasks[i] = ReduceTask{M: m, R: r, N: i, Job: cfg.JobID, SourceHosts: make([]string, m), SourceSums: make([]FileSum, m)}
+	}
+	actor.run(func(n *Node) {
+		n.startJob(cfg, "", false, mapTasks, reduceTasks, &eventLog{})
+		n.setPhase(Map)
+	})
+	for _, addr := range []string{"w1", "w2"} {
+		var wait bool
+		actor.Ping(addr, &wait)
+	}
+	return actor
+}
+
+func requestJob(t *testing.T, actor NodeActor, worker string) Job {
+	t.Helper()
+	var job Job
+	if err := actor.RequestJob(worker, &job); err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// Returns the number of the task in job, or -1 if the worker has to wait
+func taskNumber(job Job) int {
+	switch {
+	case job.Wait:
+		return -1
+	case job.MapTask != nil:
+		return job.MapTask.N
+	}
+	return job.ReduceTask.N
+}
+
+func phase(actor NodeActor) Phase {
+	var p Phase
+	actor.run(func(n *Node) {
+		p = n.Phase
+	})
+	return p
+}
+
+func TestGetNextJobAssignsTasksInOrder(t *testing.T) {
+	actor := newTestNode(t, 3, 1)
+
+	for i := 0; i < 3; i++ {
+		job := requestJob(t, actor, "w1")
+		if got := taskNumber(job); got != i || job.MapTask.Attempt != 1 {
+			t.Fatalf("request %d got map task %d attempt %d, want task %d attempt 1", i, got, job.MapTask.Attempt, i)
+		}
+	}
+	if p := phase(actor); p != MapDone {
+		t.Errorf("phase is %s once all map tasks are assigned, want %s", p, MapDone)
+	}
+	if job := requestJob(t, actor, "w2"); !job.Wait {
+		t.Errorf("got task %d with every task assigned and none worth a backup", taskNumber(job))
+	}
+}
+
+func TestGetNextJobRequeuedTasksFirst(t *testing.T) {
+	actor := newTestNode(t, 3, 1)
+	requestJob(t, actor, "w1")
+	requestJob(t, actor, "w2")
+
+	if err := actor.Drain("w1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if job := requestJob(t, actor, "w1"); !job.Wait {
+		t.Errorf("draining worker got task %d", taskNumber(job))
+	}
+	job := requestJob(t, actor, "w2")
+	if got := taskNumber(job); got != 0 || job.MapTask.Attempt != 2 {
+		t.Errorf("got map task %d attempt %d, want the requeued task 0 attempt 2", got, job.MapTask.Attempt)
+	}
+	if got := taskNumber(requestJob(t, actor, "w2")); got != 2 {
+		t.Errorf("got map task %d, want 2", got)
+	}
+}
+
+func TestGetNextJobPrefersLocalInput(t *testing.T) {
+	actor := newTestNode(t, 4, 1)
+	// Tasks 1 and 3 read files w2 wrote in an earlier stage
+	actor.run(func(n *Node) {
+		n.MapTasks[1].SourceHost = "w2"
+		n.MapTasks[3].SourceHost = "w2"
+	})
+
+	for _, want := range []int{1, 3, 0} {
+		if got := taskNumber(requestJob(t, actor, "w2")); got != want {
+			t.Errorf("w2 got map task %d, want %d", got, want)
+		}
+	}
+	if got := taskNumber(requestJob(t, actor, "w1")); got != 2 {
+		t.Errorf("w1 got map task %d, want 2", got)
+	}
+	if got := phase(actor); got != MapDone {
+		t.Errorf("phase is %s, want %s", got, MapDone)
+	}
+}
+
+func TestGetNextJobBacksUpStuckTasks(t *testing.T) {
+	actor := newTestNode(t, 2, 1)
+	requestJob(t, actor, "w1")
+	requestJob(t, actor, "w2")
+	actor.run(func(n *Node) {
+		n.MapInfo[0].Stuck = true
+	})
+
+	if job := requestJob(t, actor, "w1"); !job.Wait {
+		t.Errorf("worker got a backup of its own task %d", taskNumber(job))
+	}
+	job := requestJob(t, actor, "w2")
+	if got := taskNumber(job); got != 0 || job.MapTask.Attempt != 2 {
+		t.Fatalf("got map task %d attempt %d, want a backup of task 0 as attempt 2", got, job.MapTask.Attempt)
+	}
+	actor.run(func(n *Node) {
+		if n.MapInfo[0].Backup != "w2" {
+			t.Errorf("backup of task 0 runs on %q, want w2", n.MapInfo[0].Backup)
+		}
+	})
+}
+
+func TestGetNextJobReplacesStuckBackups(t *testing.T) {
+	actor := newTestNode(t, 2, 1)
+	var wait bool
+	actor.Ping("w3", &wait)
+	requestJob(t, actor, "w1")
+	requestJob(t, actor, "w2")
+	actor.run(func(n *Node) {
+		n.MapInfo[0].Stuck = true
+	})
+	requestJob(t, actor, "w2") // Backup of task 0
+
+	// One backup at a time while it runs
+	if job := requestJob(t, actor, "w3"); !job.Wait {
+		t.Errorf("got task %d while the backup of task 0 runs", taskNumber(job))
+	}
+
+	// The backup gets stuck too
+	actor.run(func(n *Node) {
+		n.checkStuck(Map, n.MapInfo, time.Now().Add(time.Minute))
+	})
+	job := requestJob(t, actor, "w3")
+	if got := taskNumber(job); got != 0 || job.MapTask.Attempt != 3 {
+		t.Fatalf("got map task %d attempt %d, want a new backup of task 0 as attempt 3", got, job.MapTask.Attempt)
+	}
+
+	// The new backup fails, which frees the slot for another one once the task is stuck again
+	if err := actor.FailJob(TaskFailure{Job: "job", Phase: Map, Number: 0, Attempt: 3, Addr: "w3"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	actor.run(func(n *Node) {
+		if info := n.MapInfo[0]; info.Backup != "" || info.Worker != "w1" {
+			t.Errorf("task 0 runs on %q with backup %q after its backup failed, want w1 alone", info.Worker, info.Backup)
+		}
+		n.MapInfo[0].Stuck = true
+	})
+	if got := taskNumber(requestJob(t, actor, "w3")); got != 0 {
+		t.Errorf("got map task %d, want another backup of task 0", got)
+	}
+}
+
+func TestFailJobRequeuesTheTask(t *testing.T) {
+	actor := newTestNode(t, 2, 1)
+	requestJob(t, actor, "w1")
+	requestJob(t, actor, "w2")
+	var events *eventLog
+	actor.run(func(n *Node) {
+		events = n.events
+	})
+
+	failure := TaskFailure{Job: "job", Phase: Map, Number: 0, Attempt: 1, Addr: "w1", Error: "map panicked"}
+	if err := actor.FailJob(failure, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := phase(actor); got != Map {
+		t.Errorf("phase is %s after a failure, want %s", got, Map)
+	}
+	var failed, requeued bool
+	for _, e := range events.events {
+		failed = failed || e.Type == TaskFailed && e.Task == 0 && e.Detail == "map panicked"
+		requeued = requeued || e.Type == TaskRequeued && e.Task == 0
+	}
+	if !failed || !requeued {
+		t.Errorf("events %v lack the failure and requeue of task 0", events.events)
+	}
+	job := requestJob(t, actor, "w2")
+	if got := taskNumber(job); got != 0 || job.MapTask.Attempt != 2 {
+		t.Errorf("got map task %d attempt %d, want the failed task 0 attempt 2", got, job.MapTask.Attempt)
+	}
+
+	// A failure of another job is ignored
+	if err := actor.FailJob(TaskFailure{Job: "old", Phase: Map, Number: 1, Attempt: 1, Addr: "w2"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	actor.run(func(n *Node) {
+		if n.MapInfo[1].State != InProgress {
+			t.Errorf("task 1 is %s after a failure of another job, want %s", n.MapInfo[1].State, InProgress)
+		}
+	})
+}
+
+func TestFailJobKeepsTheOtherAttempt(t *testing.T) {
+	actor := newTestNode(t, 2, 1)
+	requestJob(t, actor, "w1")
+	requestJob(t, actor, "w2")
+	actor.run(func(n *Node) {
+		n.MapInfo[0].Stuck = true
+	})
+	requestJob(t, actor, "w2") // Backup of task 0
+
+	// The original attempt fails, the backup takes over
+	if err := actor.FailJob(TaskFailure{Job: "job", Phase: Map, Number: 0, Attempt: 1, Addr: "w1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	actor.run(func(n *Node) {
+		if info := n.MapInfo[0]; info.State != InProgress || info.Worker != "w2" || info.Backup != "" {
+			t.Errorf("task 0 is %s on %q with backup %q, want in progress on w2 without a backup", info.State, info.Worker, info.Backup)
+		}
+	})
+}
+
+func TestStartEventsRecordsEarlierWorkers(t *testing.T) {
+	n := &Node{
+		Workers: make(map[string]*WorkerInfo),
+		cfg:     &Config{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))},
+	}
+	actor := n.startActor()
+	// Workers join before the job, e.g. while the input is split or between jobs of a coordinator
+	for _, addr := range []string{"w2", "w1"} {
+		var wait bool
+		actor.Ping(addr, &wait)
+	}
+	events := &eventLog{}
+	actor.run(func(n *Node) {
+		n.startEvents(events)
+	})
+	var wait bool
+	actor.Ping("w3", &wait)
+
+	var joined []string
+	actor.run(func(n *Node) {
+		for _, e := range events.events {
+			if e.Type == WorkerJoined {
+				joined = append(joined, e.Worker)
+			}
+		}
+	})
+	if want := []string{"w1", "w2", "w3"}; !slices.Equal(joined, want) {
+		t.Errorf("recorded joins of %v, want %v", joined, want)
+	}
+}
+
+func TestWaitForJobs(t *testing.T) {
+	actor := newTestNode(t, 2, 2)
+	type results struct {
+		maps, reduces []JobDone
+		err           error
+	}
+	done := make(chan results, 1)
+	go func() {
+		maps, reduces, err := actor.waitForJobs()
+		done <- results{maps, reduces, err}
+	}()
+	finish := func(result JobDone) {
+		t.Helper()
+		if err := actor.FinishJob(result, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w1, w2 := requestJob(t, actor, "w1"), requestJob(t, actor, "w2")
+	finish(JobDone{Job: "other", Phase: Map, Number: 0, Addr: "w1"})
+	finish(JobDone{Job: "job", Phase: Map, Number: 7, Addr: "w1"})
+	finish(JobDone{Job: "job", Phase: Reduce, Number: -1, Addr: "w1"})
+	finish(JobDone{Job: "job", Phase: Map, Number: taskNumber(w1), Addr: "w1", Files: map[string]FileSum{"job/map_0_output_1.db": {Size: 1}}})
+	finish(JobDone{Job: "job", Phase: Map, Number: taskNumber(w1), Addr: "w2"})
+	finish(JobDone{Job: "job", Phase: Map, Number: taskNumber(w2), Addr: "w2"})
+
+	// The map phase is over once the node has processed the completions
+	deadline := time.Now().Add(5 * time.Second)
+	for phase(actor) != Reduce {
+		if time.Now().After(deadline) {
+			t.Fatalf("phase is %s after all map tasks finished, want %s", phase(actor), Reduce)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	actor.run(func(n *Node) {
+		task := n.ReduceTasks[1]
+		if task.SourceHosts[0] != "w1" || task.SourceHosts[1] != "w2" {
+			t.Errorf("reduce task source hosts are %v, want [w1 w2]", task.SourceHosts)
+		}
+		if task.SourceSums[0].Size != 1 {
+			t.Errorf("reduce task source sums are %v, want the checksum sent by w1", task.SourceSums)
+		}
+	})
+
+	for i := 0; i < 2; i++ {
+		job := requestJob(t, actor, "w1")
+		finish(JobDone{Job: "job", Phase: Reduce, Number: taskNumber(job), Addr: "w1"})
+	}
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if r.maps[0].Addr != "w1" {
+			t.Errorf("map task 0 result is from %q, want the first completion from w1", r.maps[0].Addr)
+		}
+		if r.reduces[1].Addr != "w1" {
+			t.Errorf("reduce task 1 result is from %q, want w1", r.reduces[1].Addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waitForJobs did not return once all tasks finished")
+	}
+	if p := phase(actor); p != Merge {
+		t.Errorf("phase is %s, want %s", p, Merge)
+	}
+}
+
+func TestWaitForJobsCanceled(t *testing.T) {
+	actor := newTestNode(t, 2, 1)
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := actor.waitForJobs()
+		done <- err
+	}()
+
+	if err := actor.Cancel("job", nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, errCanceled) {
+			t.Errorf("waitForJobs returned %v, want %v", err, errCanceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waitForJobs did not return after the job was canceled")
+	}
+}
+
+func TestCancelWithCompletionsQueued(t *testing.T) {
+	actor := newTestNode(t, 2, 1)
+	// Completions fill the queue before waitForJobs gets to them
+	for i := 0; i < 10; i++ {
+		if err := actor.FinishJob(JobDone{Job: "job", Phase: Map, Number: i % 2, Addr: "w1"}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	canceled := make(chan error, 1)
+	go func() {
+		canceled <- actor.Cancel("job", nil)
+	}()
+	select {
+	case err := <-canceled:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Cancel blocked on the queue of completions")
+	}
+	if _, _, err := actor.waitForJobs(); !errors.Is(err, errCanceled) {
+		t.Errorf("waitForJobs returned %v, want %v", err, errCanceled)
+	}
+}
+
+func TestWaitForJobsMapOnly(t *testing.T) {
+	actor := newTestNode(t, 2, 0)
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := actor.waitForJobs()
+		done <- err
+	}()
+
+	for _, worker := range []string{"w1", "w2"} {
+		job := requestJob(t, actor, worker)
+		if err := actor.FinishJob(JobDone{Job: "job", Phase: Map, Number: taskNumber(job), Addr: worker}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waitForJobs did not return once all map tasks finished")
+	}
+	if p := phase(actor); p != Merge {
+		t.Errorf("phase is %s after the map phase of a map-only job, want %s", p, Merge)
+	}
+}
+
+// Waits for the node to process the completions sent to it
+func waitUntil(t *testing.T, actor NodeActor, what string, cond func(n *Node) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var ok bool
+		actor.run(func(n *Node) {
+			ok = cond(n)
+		})
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFailJobRerunsLostMapTasks(t *testing.T) {
+	actor := newTestNode(t, 2, 1)
+	go actor.waitForJobs()
+	for _, worker := range []string{"w1", "w2"} {
+		job := requestJob(t, actor, worker)
+		if err := actor.FinishJob(JobDone{Job: "job", Phase: Map, Number: taskNumber(job), Addr: worker}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitUntil(t, actor, "the reduce phase starts", func(n *Node) bool { return n.Phase == Reduce })
+
+	// w2 can't download the output of map task 0 from w1
+	requestJob(t, actor, "w2")
+	failure := TaskFailure{Job: "job", Phase: Reduce, Number: 0, Attempt: 1, Addr: "w2", Error: "connection refused", Unreachable: "w1"}
+	if err := actor.FailJob(failure, nil); err != nil {
+		t.Fatal(err)
+	}
+	job := requestJob(t, actor, "w2")
+	if job.MapTask == nil || job.MapTask.N != 0 || job.MapTask.Attempt != 2 {
+		t.Fatalf("got task %d of %+v, want map task 0 attempt 2", taskNumber(job), job)
+	}
+	if job := requestJob(t, actor, "w2"); !job.Wait {
+		t.Errorf("got task %d while map task 0 runs again, want to wait", taskNumber(job))
+	}
+
+	if err := actor.FinishJob(JobDone{Job: "job", Phase: Map, Number: 0, Addr: "w2"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, actor, "map task 0 completes again", func(n *Node) bool { return n.MapInfo[0].State == Completed })
+	job = requestJob(t, actor, "w2")
+	if job.ReduceTask == nil || job.ReduceTask.Attempt != 2 || job.ReduceTask.SourceHosts[0] != "w2" {
+		t.Fatalf("got %+v, want reduce task 0 attempt 2 reading map task 0 from w2", job)
+	}
+}
+
+func TestFailJobFailsTheJob(t *testing.T) {
+	actor := newTestNode(t, 1, 1)
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := actor.waitForJobs()
+		done <- err
+	}()
+
+	for attempt := 1; attempt <= maxTaskFailures; attempt++ {
+		requestJob(t, actor, "w1")
+		failure := TaskFailure{Job: "job", Phase: Map, Number: 0, Attempt: attempt, Addr: "w1", Error: "map panicked"}
+		if err := actor.FailJob(failure, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "failed 4 times") {
+			t.Errorf("waitForJobs returned %v, want the task failing too often", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waitForJobs did not return after a task failed too often")
+	}
+}
+
+func TestReportCorruptionRedoesTheMapTask(t *testing.T) {
+	actor := newTestNode(t, 2, 1)
+	go actor.waitForJobs()
+	for _, worker := range []string{"w1", "w2"} {
+		job := requestJob(t, actor, worker)
+		if err := actor.FinishJob(JobDone{Job: "job", Phase: Map, Number: taskNumber(job), Addr: worker}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitUntil(t, actor, "the reduce phase starts", func(n *Node) bool { return n.Phase == Reduce })
+
+	// Files other than map outputs of the stage, or served by another host, are left alone
+	for _, u := range []string{"http://w1/data/job/map_0_source.db", "http://w2/data/job/map_0_output_0.db", "http://w1/data/old/map_0_output_0.db"} {
+		if err := actor.ReportCorruption(Corruption{Addr: "w2", URL: u}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if job := requestJob(t, actor, "w2"); job.ReduceTask == nil {
+		t.Fatalf("got %+v after corruption reports of other files, want reduce task 0", job)
+	}
+
+	if err := actor.ReportCorruption(Corruption{Addr: "w2", URL: "http://w1/data/job/map_0_output_0.db"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	actor.run(func(n *Node) {
+		if n.MapInfo[0].State != Idle || len(n.Corruptions) != 4 {
+			t.Errorf("map task 0 is %s with %d corruptions recorded, want idle with 4", n.MapInfo[0].State, len(n.Corruptions))
+		}
+	})
+	job := requestJob(t, actor, "w1")
+	if job.MapTask == nil || job.MapTask.N != 0 {
+		t.Errorf("got %+v, want map task 0 to rewrite its output", job)
+	}
+}
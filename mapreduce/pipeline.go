@@ -0,0 +1,107 @@
+package mapreduce
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type (
+	// Stage is one job of a pipeline. Its map tasks read the final parts of earlier stages straight from the
+	// workers that wrote them, without merging them first.
+	Stage struct {
+		Name   string    // Names the stage's task files and client, required when there is more than one stage
+		Client Interface // Map and reduce functions of the stage
+		R      int       // Number of reduce tasks, 0 for a map-only stage
+		Inputs []string  // Earlier stages whose outputs are the map input, the previous stage if empty
+
+		// Called on the master once the stage is done, returning true ends the pipeline with this stage's output
+		Converged func(it *Iteration) (bool, error)
+	}
+
+	// A file making up the output of a stage
+	outputPart struct {
+		Host string
+		File string
+		Sum  FileSum
+	}
+)
+
+// RunPipeline starts a master or worker node that runs the stages one after another on the same workers, and
+// blocks until it is done. The first stage reads cfg.InputPath split into cfg.M shards, each later stage gets one
+// map task per output file of its inputs, and only the output of the last stage is merged into cfg.OutputPath.
+// Workers must be started with the same stages as the master.
+func RunPipeline(cfg Config, stages []Stage) error {
+	if err := validateStages(stages); err != nil {
+		return err
+	}
+	if err := cfg.setup(); err != nil {
+		return err
+	}
+
+	if cfg.Master {
+		cfg.Logger.Info("starting master node", "host", cfg.Host)
+		if err := startMaster(&cfg, stages); err != nil {
+			return fmt.Errorf("master failure %v", err)
+		}
+	} else {
+		cfg.Logger.Info("starting worker node", "host", cfg.Host)
+		if cfg.MasterAddr == cfg.Host {
+			return fmt.Errorf("master address is same as worker (%s == %s)", cfg.MasterAddr, cfg.Host)
+		}
+		if err := startWorker(&cfg, stages); err != nil {
+			return fmt.Errorf("worker failure: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func validateStages(stages []Stage) error {
+	if len(stages) == 0 {
+		return errors.New("a pipeline needs at least one stage")
+	}
+	seen := make(map[string]bool)
+	for i, stage := range stages {
+		switch {
+		case stage.Client == nil:
+			return fmt.Errorf("stage %d has no client", i)
+		case len(stages) > 1 && stage.Name == "":
+			return fmt.Errorf("stage %d has no name, which pipelines of several stages need", i)
+		case strings.ContainsAny(stage.Name, `/\`) || stage.Name == "." || stage.Name == "..":
+			return fmt.Errorf("invalid stage name %q", stage.Name)
+		case seen[stage.Name]:
+			return fmt.Errorf("duplicate stage name %q", stage.Name)
+		case stage.R < 0:
+			return fmt.Errorf("stage %q has a negative R", stage.Name)
+		case i == 0 && len(stage.Inputs) > 0:
+			return fmt.Errorf("the first stage %q reads the job input and can't have inputs", stage.Name)
+		}
+		for _, input := range stage.Inputs {
+			if !seen[input] {
+				return fmt.Errorf("stage %q reads %q, which is not an earlier stage", stage.Name, input)
+			}
+		}
+		seen[stage.Name] = true
+	}
+	return nil
+}
+
+// Names of the stages whose outputs are the map input of stage i
+func stageInputs(stages []Stage, i int) []string {
+	if len(stages[i].Inputs) > 0 {
+		return stages[i].Inputs
+	}
+	return []string{stages[i-1].Name}
+}
+
+// Returns the URLs and checksums of the parts
+func (cfg *Config) partURLs(parts []outputPart) ([]string, []FileSum) {
+	urls := make([]string, len(parts))
+	sums := make([]FileSum, len(parts))
+	for i, part := range parts {
+		urls[i] = cfg.makeURL(part.Host, part.File)
+		sums[i] = part.Sum
+	}
+	return urls, sums
+}
@@ -0,0 +1,205 @@
+package mapreduce
+
+import (
+	"errors"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	progressInterval   = time.Second     // How often workers report progress and the master looks for stuck tasks
+	backupMinRemaining = 5 * time.Second // Tasks expected to run at least this much longer are worth a speculative backup
+)
+
+// Returned by tasks the master no longer needs, because they finished elsewhere or their job ended
+var errAbandoned = errors.New("task abandoned")
+
+type (
+	// Progress is sent by a worker while it runs a task
+	Progress struct {
+		Job     string
+		Stage   string
+		Phase   Phase
+		Number  int
+		Attempt int
+		Addr    string
+		Done    int64 // Rows processed so far
+		Total   int64 // Rows to process, 0 if not known yet
+	}
+
+	// Counts the rows processed by a running task. A nil taskProgress counts nothing.
+	taskProgress struct {
+		done, total atomic.Int64
+		abandoned   atomic.Bool // Set when the master no longer needs the task
+	}
+)
+
+func (p *taskProgress) setTotal(total int64) {
+	if p != nil {
+		p.total.Store(total)
+	}
+}
+
+func (p *taskProgress) add(rows int64) {
+	if p != nil {
+		p.done.Add(rows)
+	}
+}
+
+// Returns errAbandoned once the master told the worker to give up on the task
+func (p *taskProgress) check() error {
+	if p != nil && p.abandoned.Load() {
+		return errAbandoned
+	}
+	return nil
+}
+
+// Reports the progress of the task identified by p to the master until the returned function is called
+func (cfg *Config) reportProgress(p Progress) func() {
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				progress := p
+				progress.Addr = cfg.Host
+				progress.Done = cfg.progress.done.Load()
+				progress.Total = cfg.progress.total.Load()
+				var abandon bool
+				if err := cfg.call(cfg.MasterAddr, "NodeActor.ReportProgress", progress, &abandon); err != nil {
+					cfg.Logger.Debug("error reporting progress", "err", err)
+				} else if abandon {
+					cfg.progress.abandoned.Store(true)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+// A worker reports how far it got with a task. The reply tells it to abandon the task if nobody needs it anymore.
+func (a NodeActor) ReportProgress(p Progress, abandon *bool) error {
+	a.run(func(n *Node) {
+		n.seen(p.Addr)
+		info := n.taskInfo(p.Phase, p.Number)
+		if p.Job != n.JobID || p.Stage != n.Stage || n.canceled || info == nil || info.State != InProgress || p.Addr != info.Worker && p.Addr != info.Backup {
+			*abandon = true
+			return
+		}
+		info.progress(p.Done, p.Total, p.Addr == info.Backup)
+	})
+	return nil
+}
+
+// Returns the scheduling state of a task, or nil if there is no such task
+func (n *Node) taskInfo(phase Phase, number int) *TaskInfo {
+	infos := n.MapInfo
+	if phase == Reduce {
+		infos = n.ReduceInfo
+	}
+	if number < 0 || number >= len(infos) {
+		return nil
+	}
+	return &infos[number]
+}
+
+// Keeps the furthest progress of any attempt. A backup catching up with it makes progress too.
+func (t *TaskInfo) progress(done, total int64, backup bool) {
+	if total > 0 {
+		t.Total = total
+	}
+	moved := done > t.Done
+	if backup && done > t.BackupDone {
+		t.BackupDone = done
+		moved = true
+	}
+	if done > t.Done {
+		t.Done = done
+	}
+	if moved {
+		t.Progressed = time.Now()
+		t.Stuck = false
+	}
+}
+
+// Estimates the time until the task finishes from its progress rate so far
+func (t *TaskInfo) remaining(now time.Time) (time.Duration, bool) {
+	if t.Done <= 0 || t.Total <= 0 {
+		return 0, false
+	}
+	elapsed := now.Sub(t.Started)
+	return time.Duration(float64(elapsed) / float64(t.Done) * float64(t.Total-t.Done)), true
+}
+
+// Fraction of the task's rows processed, -1 if unknown
+func (t *TaskInfo) fraction() float64 {
+	switch {
+	case t.State == Completed:
+		return 1
+	case t.Total <= 0:
+		return -1
+	}
+	return float64(t.Done) / float64(t.Total)
+}
+
+// Looks for stuck tasks every progressInterval until stop is closed
+func (a NodeActor) watchProgress(stop <-chan struct{}) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			a.run(func(n *Node) {
+				n.checkStuck(Map, n.MapInfo, now)
+				n.checkStuck(Reduce, n.ReduceInfo, now)
+			})
+		}
+	}
+}
+
+// Marks running tasks whose progress hasn't moved within the stuck timeout
+func (n *Node) checkStuck(phase Phase, infos []TaskInfo, now time.Time) {
+	for i := range infos {
+		info := &infos[i]
+		if info.State != InProgress || info.Stuck || now.Sub(info.Progressed) < n.cfg.StuckTimeout {
+			continue
+		}
+		info.Stuck = true
+		n.cfg.Logger.Warn("task stuck", "phase", phase.String(), "task", i, "worker", info.Worker, "done", info.Done, "total", info.Total, "since", info.Progressed)
+		n.events.record(Event{Type: TaskStuck, Phase: phase.String(), Task: i, Attempt: info.Attempts, Worker: info.Worker})
+	}
+}
+
+// Picks the running task expected to finish last if it is worth backing up on workerAddr, or -1.
+// Stuck tasks come first, then tasks whose progress rate says they still need at least backupMinRemaining.
+// A task has one backup at a time, which is replaced once the task is stuck again.
+func backupCandidate(infos []TaskInfo, workerAddr string, now time.Time) int {
+	best, bestRemaining := -1, time.Duration(0)
+	for i := range infos {
+		info := &infos[i]
+		if info.State != InProgress || info.Worker == workerAddr || info.Backup == workerAddr || info.Backup != "" && !info.Stuck {
+			continue
+		}
+		remaining, ok := info.remaining(now)
+		if info.Stuck {
+			remaining = math.MaxInt64
+		} else if !ok || remaining < backupMinRemaining {
+			continue
+		}
+		if best < 0 || remaining > bestRemaining {
+			best, bestRemaining = i, remaining
+		}
+	}
+	return best
+}
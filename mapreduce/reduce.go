@@ -1,17 +1,24 @@
 package mapreduce
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"os"
 	"path/filepath"
 )
 
 type (
 	ReduceTask struct {
-		M, R        int      // total number of map and reduce tasks
-		N           int      // reduce task number, 0-based
-		SourceHosts []string // addresses of map workers
+		M, R        int         // total number of map and reduce tasks
+		N           int         // reduce task number, 0-based
+		Job         string      // ID of the job the task belongs to
+		Stage       string      // pipeline stage the task belongs to, empty for single-stage jobs
+		Attempt     int         // attempt number assigned by the master, 1-based
+		SourceHosts []string    // addresses of map workers
+		SourceSums  []FileSum   // checksums of the map output files for this task
+		Compression string      // codec used for the output file
+		Cache       []CacheFile // files of the distributed cache
 	}
 
 	KeyBatch struct {
@@ -23,83 +30,215 @@ type (
 // Filename helpers
 
 func (task *ReduceTask) mapInputFile(mapTaskNumber int) string {
-	return fmt.Sprintf("map_%d_output_%d.db", mapTaskNumber, task.N)
+	return jobFile(task.Job, task.Stage, fmt.Sprintf("map_%d_output_%d.db", mapTaskNumber, task.N))
 }
 
 func (task *ReduceTask) inputFile() string {
-	return fmt.Sprintf("reduce_%d_input.db", task.N)
+	return jobFile(task.Job, task.Stage, fmt.Sprintf("reduce_%d_input.db", task.N))
 }
 
 func (task *ReduceTask) outputFile() string {
-	return fmt.Sprintf("reduce_%d_output.db", task.N)
+	return jobFile(task.Job, task.Stage, fmt.Sprintf("reduce_%d_output.db", task.N))
+}
+
+func (task *ReduceTask) sideFile(name string) string {
+	return jobFile(task.Job, task.Stage, fmt.Sprintf("reduce_%d_side_%s.db", task.N, name))
 }
 
 func (task *ReduceTask) tempFile() string {
-	return fmt.Sprintf("reduce_%d_temp.db", task.N)
+	return jobFile(task.Job, task.Stage, fmt.Sprintf("reduce_%d_temp.db", task.N))
 }
 
 // Actual reducer logic
 
-func (task *ReduceTask) Process(tempdir string, client Interface) error {
+// Runs the reduce task, returning the result to report to the master (without the worker address)
+func (task *ReduceTask) Process(cfg *Config, client Interface) (JobDone, error) {
+	tempdir := cfg.Tempdir
+	result := JobDone{
+		Job:    task.Job,
+		Stage:  task.Stage,
+		Phase:  Reduce,
+		Number: task.N,
+		Files:  make(map[string]FileSum),
+	}
+
+	if err := os.MkdirAll(filepath.Join(tempdir, task.Job, task.Stage), os.ModePerm); err != nil {
+		return result, fmt.Errorf("creating job dir: %v", err)
+	}
+
+	// Fetch the cache files before any client code runs
+	cache, err := cfg.fetchCache(task.Job, task.Cache)
+	if err != nil {
+		return result, fmt.Errorf("fetching cache files: %w", err)
+	}
+	defer cache.close()
+
 	// Create input database by merging all map outputs
 
 	// Get correct URLs for input files
 	urls := make([]string, task.M)
 	for i := 0; i < task.M; i++ {
-		urls[i] = makeURL(task.SourceHosts[i], task.mapInputFile(i))
+		urls[i] = cfg.makeURL(task.SourceHosts[i], task.mapInputFile(i))
 	}
 
-	inDB, err := mergeDatabases(urls, filepath.Join(tempdir, task.inputFile()), filepath.Join(tempdir, task.tempFile()))
+	endFetch := cfg.spans.start("shuffle fetch", "files", task.M)
+	inDB, err := cfg.mergeDatabases(urls, task.SourceSums, filepath.Join(tempdir, task.inputFile()), filepath.Join(tempdir, task.tempFile()))
+	endFetch()
 	if err != nil {
-		return fmt.Errorf("merging databases: %v", err)
+		return result, fmt.Errorf("merging databases: %w", err)
 	}
 	defer inDB.Close()
 
+	total, err := countPairs(inDB)
+	if err != nil {
+		return result, fmt.Errorf("sizing input db: %v", err)
+	}
+	cfg.progress.setTotal(total)
+
 	// Create output database
 	outDB, err := createDatabase(filepath.Join(tempdir, task.outputFile()))
 	if err != nil {
-		return fmt.Errorf("creating out database: %v", err)
+		return result, fmt.Errorf("creating out database: %v", err)
 	}
 	defer outDB.Close()
 	outStmt, err := outDB.Prepare("INSERT INTO pairs (key, value) values (?, ?)")
 	if err != nil {
-		return fmt.Errorf("preparing insert statement: %v", err)
+		return result, fmt.Errorf("preparing insert statement: %v", err)
 	}
 	defer outStmt.Close()
 
 	// Stats
 	keyCount, valCount, outCount := 0, 0, 0
+	ctx := newTaskContext(Reduce, task.N)
+	ctx.sides = newSideOutputs(tempdir, task.sideFile)
+	defer ctx.sides.close()
+	ctx.cache = cache
 
-	// Process using client.Reduce
-	rows, err := inDB.Query("SELECT key, value FROM pairs ORDER BY key, value")
-	if err != nil {
-		return fmt.Errorf("querying input db: %v", err)
+	// Sort up front (with a covering index by default), so the ordered scan below doesn't hide the sort in its first row
+	var rows *sql.Rows
+	endSort := cfg.spans.start("sort")
+	if sorter, ok := findHook[SortComparator](client); ok {
+		// The comparator is registered on a single connection, which the scan has to use too
+		conn, err := inDB.Conn(context.Background())
+		if err != nil {
+			return result, fmt.Errorf("opening input db connection: %v", err)
+		}
+		defer conn.Close()
+		rows, err = sortWithComparator(conn, sorter)
+		if err != nil {
+			return result, fmt.Errorf("sorting input db: %v", err)
+		}
+	} else {
+		if _, err := inDB.Exec("CREATE INDEX pairs_sorted ON pairs (key, value)"); err != nil {
+			return result, fmt.Errorf("sorting input db: %v", err)
+		}
+		if rows, err = inDB.Query("SELECT key, value FROM pairs ORDER BY key, value"); err != nil {
+			return result, fmt.Errorf("querying input db: %v", err)
+		}
 	}
+	endSort()
 	defer rows.Close()
 
+	// Process using client.Reduce
+	endReduce := cfg.spans.start("reduce")
 	keyBatches := make(chan KeyBatch)
 	readDone, writeDone := make(chan error), make(chan error)
 
-	go readInput(rows, keyBatches, readDone, &valCount)
+	if err := callSetup(ctx, client); err != nil {
+		return result, fmt.Errorf("client reduce setup failure: %v", err)
+	}
+
+	go readInput(rows, groupFunc(client), keyBatches, readDone, &valCount, cfg.progress)
+	// Stops readInput after a batch failed and waits for it to exit, so it no longer uses rows
+	stopReading := func(batch KeyBatch, err error) error {
+		drain(batch.Input)
+		select {
+		case readDone <- err:
+			<-readDone
+		case <-readDone:
+			// It already stopped on an error of its own
+		}
+		return err
+	}
 
 	for batch := range keyBatches {
+		if err := cfg.progress.check(); err != nil {
+			return result, stopReading(batch, err)
+		}
 		keyCount++
 		reduceOut := make(chan Pair, 200)
 
 		go task.writeOutput(reduceOut, writeDone, outStmt, &outCount)
 
-		if err := client.Reduce(batch.Key, batch.Input, reduceOut); err != nil {
-			return fmt.Errorf("client reduce failure: %v", err)
+		if err := callReduce(ctx, client, batch.Key, batch.Input, reduceOut); err != nil {
+			closeOutput(reduceOut)
+			<-writeDone
+			return result, stopReading(batch, fmt.Errorf("client reduce failure: %v", err))
 		}
 
-		// Wait for goroutines to finish batch (pipe write err to read so errors cascade)
-		readDone <- <-writeDone
+		// Values the reducer left unread still have to be read for the next batch to start
+		drain(batch.Input)
+		if err := <-writeDone; err != nil {
+			return result, stopReading(batch, fmt.Errorf("writing output: %v", err))
+		}
+		select {
+		case readDone <- nil:
+			// On to the next batch
+		case err := <-readDone:
+			// Reading the input failed during the batch
+			return result, err
+		}
+	}
+	// readInput exits once the batches are done
+	if err := <-readDone; err != nil {
+		return result, err
+	}
+
+	// The cleanup can emit final pairs, like a Reduce call
+	if cleanup := cleanupHook(ctx, client); cleanup != nil {
+		reduceOut := make(chan Pair, 200)
+		go task.writeOutput(reduceOut, writeDone, outStmt, &outCount)
+		if err := cleanup(reduceOut); err != nil {
+			closeOutput(reduceOut)
+			<-writeDone
+			return result, fmt.Errorf("client reduce cleanup failure: %v", err)
+		}
+		if err := <-writeDone; err != nil {
+			return result, fmt.Errorf("writing output: %v", err)
+		}
 	}
+	endReduce()
+
+	// Close, checksum and compress the output so it can be served
+	outStmt.Close()
+	if err := outDB.Close(); err != nil {
+		return result, fmt.Errorf("closing out database: %v", err)
+	}
+	outPath := filepath.Join(tempdir, task.outputFile())
+	sum, err := sumFile(outPath)
+	if err != nil {
+		return result, fmt.Errorf("checksumming output file: %v", err)
+	}
+	result.Files[task.outputFile()] = sum
+	saved, err := compressFile(outPath, task.Compression)
+	if err != nil {
+		return result, fmt.Errorf("compressing output file: %v", err)
+	}
+	result.Stats.BytesSaved = saved
+	if err := ctx.sides.finish(task.Compression, &result); err != nil {
+		return result, err
+	}
+
+	result.Counters = ctx.snapshot()
+	result.Stats.Keys, result.Stats.InPairs, result.Stats.OutPairs = keyCount, valCount, outCount
 
 	// Log stats
-	log.Printf("reduce task %d processed %d keys and %d values, generated %d pairs\n", task.N, keyCount, valCount, outCount)
+	reduceKeys.add(float64(keyCount))
+	reduceValues.add(float64(valCount))
+	reduceOutput.add(float64(outCount))
+	cfg.Logger.Info("reduce task completed", "keys", keyCount, "values", valCount, "out_pairs", outCount, "bytes_saved", result.Stats.BytesSaved)
 
-	return nil
+	return result, nil
 }
 
 // Handle writing of reduce output to the out db
@@ -115,10 +254,11 @@ func (task *ReduceTask) writeOutput(output <-chan Pair, done chan<- error, stmt
 	done <- nil
 }
 
-// Handle reading from input db and sending to client reduce function
-func readInput(rows *sql.Rows, batchChannel chan<- KeyBatch, done chan error, valCount *int) {
+// Handle reading from input db and sending to client reduce function, one batch per group of keys
+func readInput(rows *sql.Rows, sameGroup func(a, b string) (bool, error), batchChannel chan<- KeyBatch, done chan error, valCount *int, progress *taskProgress) {
 	var retErr error
 	var prevKey string
+	var started bool // Whether a group was started, as any key including "" can be the first
 	var currInput chan string
 	// Defer error and signal for main to close
 	defer func() {
@@ -129,16 +269,25 @@ func readInput(rows *sql.Rows, batchChannel chan<- KeyBatch, done chan error, va
 	for rows.Next() {
 		var key, value string
 		if err := rows.Scan(&key, &value); err != nil {
-			if prevKey != "" {
+			if started {
 				close(currInput)
 			}
 			retErr = fmt.Errorf("reading a row from input db: %v", err)
 			return
 		}
 
-		// If keys have changed
-		if prevKey != key {
-			if prevKey != "" {
+		// If the group of keys has changed
+		same := false
+		if started {
+			var err error
+			if same, err = sameGroup(prevKey, key); err != nil {
+				close(currInput)
+				retErr = err
+				return
+			}
+		}
+		if !same {
+			if started {
 				// Close previous call if not first key
 				close(currInput)
 				// Wait for output to finish
@@ -155,17 +304,18 @@ func readInput(rows *sql.Rows, batchChannel chan<- KeyBatch, done chan error, va
 			}
 		}
 		*valCount++
+		progress.add(1)
 		currInput <- value
 
-		prevKey = key
+		prevKey, started = key, true
 	}
 	// Check for errors from iterating over rows.
 	if err := rows.Err(); err != nil {
-		if prevKey != "" {
-			close(currInput)
-		}
 		retErr = fmt.Errorf("iterating over downloaded db: %v", err)
 	}
+	if !started {
+		return
+	}
 
 	// Close last call
 	close(currInput)
@@ -0,0 +1,151 @@
+package mapreduce
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+type (
+	// Report describes a finished job. It is written as JSON next to the output db.
+	// There is no count of skipped records because records are never skipped: a record whose Map or Reduce call
+	// fails (or panics) fails the task attempt, which is listed in the Failures of its task and retried.
+	Report struct {
+		Success     bool
+		Error       string `json:",omitempty"`
+		JobID       string
+		Config      ReportConfig
+		Started     time.Time
+		Finished    time.Time
+		Duration    float64 // Seconds
+		MapTasks    []TaskReport
+		ReduceTasks []TaskReport
+		Totals      ReportTotals
+		Counters    Counters
+		Corruptions []Corruption // Corrupt downloads reported by workers
+	}
+
+	ReportConfig struct {
+		M, R        int
+		Input       string
+		Output      string
+		Compression string
+		Sorted      bool // Whether the output rows are in canonical order
+	}
+
+	TaskReport struct {
+		Stage    string `json:",omitempty"` // Pipeline stage
+		Number   int
+		Worker   string
+		Started  time.Time
+		Finished time.Time
+		Duration float64 // Seconds
+		Attempts int
+		Failures []FailedAttempt `json:",omitempty"` // Attempts that failed, with the worker's error
+		Stats    TaskStats
+	}
+
+	ReportTotals struct {
+		MapInputPairs     int
+		MapOutputPairs    int
+		ReduceKeys        int
+		ReduceValues      int
+		ReduceOutputPairs int
+		SidePairs         int   // Pairs emitted to side outputs
+		BytesShuffled     int64 // Size of all intermediate files (uncompressed)
+		BytesSaved        int64 // Bytes saved by compression
+	}
+)
+
+// Builds the report from the final state of the master node and the task results, without the user counters
+func (n *Node) report(mapResults, reduceResults []JobDone) Report {
+	report := Report{
+		JobID: n.cfg.JobID,
+		Config: ReportConfig{
+			M:           len(n.MapTasks),
+			R:           len(n.ReduceTasks),
+			Input:       n.cfg.InputPath,
+			Output:      n.cfg.OutputPath,
+			Compression: n.cfg.Compression,
+			Sorted:      n.cfg.SortedOutput,
+		},
+		Started:     n.Started,
+		MapTasks:    taskReports(n.Stage, n.MapInfo, mapResults),
+		ReduceTasks: taskReports(n.Stage, n.ReduceInfo, reduceResults),
+		Corruptions: n.Corruptions,
+	}
+
+	for _, result := range mapResults {
+		report.Totals.MapInputPairs += result.Stats.InPairs
+		report.Totals.MapOutputPairs += result.Stats.OutPairs
+		report.Totals.SidePairs += result.Stats.SidePairs
+		report.Totals.BytesSaved += result.Stats.BytesSaved
+		for _, sum := range result.Files {
+			report.Totals.BytesShuffled += sum.Size
+		}
+	}
+	for _, result := range reduceResults {
+		report.Totals.ReduceKeys += result.Stats.Keys
+		report.Totals.ReduceValues += result.Stats.InPairs
+		report.Totals.ReduceOutputPairs += result.Stats.OutPairs
+		report.Totals.SidePairs += result.Stats.SidePairs
+		report.Totals.BytesSaved += result.Stats.BytesSaved
+	}
+
+	return report
+}
+
+func taskReports(stage string, infos []TaskInfo, results []JobDone) []TaskReport {
+	reports := make([]TaskReport, len(infos))
+	for i, info := range infos {
+		reports[i] = TaskReport{
+			Stage:    stage,
+			Number:   i,
+			Worker:   info.Worker,
+			Started:  info.Started,
+			Finished: info.Finished,
+			Duration: info.Finished.Sub(info.Started).Seconds(),
+			Attempts: info.Attempts,
+			Failures: info.Failures,
+			Stats:    results[i].Stats,
+		}
+	}
+	return reports
+}
+
+// Adds the tasks, totals and failures of a later stage of a pipeline
+func (r *Report) add(stage Report) {
+	r.Config.M += stage.Config.M
+	r.Config.R += stage.Config.R
+	r.MapTasks = append(r.MapTasks, stage.MapTasks...)
+	r.ReduceTasks = append(r.ReduceTasks, stage.ReduceTasks...)
+	r.Totals.MapInputPairs += stage.Totals.MapInputPairs
+	r.Totals.MapOutputPairs += stage.Totals.MapOutputPairs
+	r.Totals.ReduceKeys += stage.Totals.ReduceKeys
+	r.Totals.ReduceValues += stage.Totals.ReduceValues
+	r.Totals.ReduceOutputPairs += stage.Totals.ReduceOutputPairs
+	r.Totals.SidePairs += stage.Totals.SidePairs
+	r.Totals.BytesShuffled += stage.Totals.BytesShuffled
+	r.Totals.BytesSaved += stage.Totals.BytesSaved
+	r.Corruptions = append(r.Corruptions, stage.Corruptions...)
+}
+
+// Records the outcome and writes the report as JSON to path
+func (r *Report) save(path string, jobErr error) error {
+	r.Finished = time.Now()
+	r.Duration = r.Finished.Sub(r.Started).Seconds()
+	r.Success = jobErr == nil
+	if jobErr != nil {
+		r.Error = jobErr.Error()
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding report: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("writing report: %v", err)
+	}
+	return nil
+}
@@ -1,8 +1,11 @@
 package mapreduce
 
 import (
-	"log"
+	"fmt"
 	"net/rpc"
+	"net/url"
+	"strings"
+	"time"
 )
 
 type (
@@ -12,10 +15,64 @@ type (
 		DoneJobs    int
 		MapTasks    []MapTask
 		ReduceTasks []ReduceTask
+		MapInfo     []TaskInfo // Scheduling state of each map task
+		ReduceInfo  []TaskInfo // Scheduling state of each reduce task
+		Started     time.Time  // When the map phase started
 		Done        chan JobDone
-		Workers     map[string]struct{} // Worker addresses
+		wake        chan struct{}          // Wakes up waitForJobs when the job is canceled or failed (master only)
+		Workers     map[string]*WorkerInfo // Worker addresses
+		Corruptions []Corruption           // Corrupt downloads reported by workers
+		JobID       string                 // Job the tasks belong to
+		Stage       string                 // Pipeline stage the tasks belong to
+		Jobs        []*JobInfo             // Jobs submitted to a coordinator, oldest first
+
+		cfg      *Config   // Settings of the current job
+		events   *eventLog // Scheduling timeline (master only)
+		canceled bool      // Whether the current job was canceled
+		failed   error     // Why the current job failed, if a task failed too often
+		more     bool      // Whether stages of the current job remain after this one
+		queued   chan struct{}
+
+		taskLogs     map[TaskRef]*logBuffer // Log lines of recent tasks (workers only)
+		taskLogOrder []TaskRef              // Oldest first
+	}
+
+	// TaskInfo tracks a task on the master
+	TaskInfo struct {
+		State    TaskState
+		Worker   string // Address of the worker the task was assigned to
+		Attempts int    // Number of times the task was assigned
+		Started  time.Time
+		Finished time.Time
+		SpanID   string // Span of the current attempt, if tracing
+
+		Done       int64     // Rows processed, as last reported by a worker
+		Total      int64     // Rows the task has to process, 0 if not reported yet
+		Progressed time.Time // Last time Done moved
+		Stuck      bool      // Whether progress stopped moving for longer than the stuck timeout
+		Backup     string    // Worker running a speculative backup attempt, if any
+		BackupDone int64     // Rows processed by the backup attempt
+
+		Failures []FailedAttempt // Attempts that failed, oldest first
+	}
+
+	// FailedAttempt is an attempt of a task that failed on a worker
+	FailedAttempt struct {
+		Attempt int
+		Worker  string
+		Time    time.Time
+		Error   string
+	}
+
+	// WorkerInfo tracks a connected worker on the master
+	WorkerInfo struct {
+		LastSeen time.Time // Last time the worker made an RPC call
+		Draining bool      // Whether the worker is no longer given tasks
 	}
 
+	// The scheduling state of a task
+	TaskState int
+
 	// NodeActor represents an RPC actor for the mapreduce node
 	NodeActor chan<- handler
 	// Some operation on a Node
@@ -25,13 +82,45 @@ type (
 	Job struct {
 		Phase      Phase
 		Wait       bool // Whether this Job contains an actual job or the worker should just wait
+		Persistent bool // The master is a coordinator or more pipeline stages follow, keep asking for jobs after this phase ends
 		MapTask    *MapTask
 		ReduceTask *ReduceTask
+		Trace      TraceContext // Parent span for the task, empty if not tracing
 	}
 
 	JobDone struct {
-		Number int
-		Addr   string
+		Job      string // ID of the job the task belongs to
+		Stage    string // Pipeline stage the task belongs to
+		Phase    Phase  // Phase of the completed task
+		Number   int
+		Addr     string
+		Stats    TaskStats
+		Files    map[string]FileSum // Checksums of the files produced by the task
+		Sides    []string           // Side outputs the task emitted to, sorted
+		Counters Counters           // User counters reported by the task
+		Spans    []Span             // Spans recorded while running the task
+	}
+
+	// TaskFailure is sent by a worker when a task attempt fails
+	TaskFailure struct {
+		Job     string // ID of the job the task belongs to
+		Stage   string // Pipeline stage the task belongs to
+		Phase   Phase
+		Number  int
+		Attempt int
+		Addr    string
+		Error   string
+
+		Unreachable string // Host a download of the task kept failing from, whose files are lost
+	}
+
+	// TaskStats summarizes the work done by a single task
+	TaskStats struct {
+		InPairs    int   // Pairs read (map input pairs or reduce input values)
+		OutPairs   int   // Pairs generated
+		SidePairs  int   // Pairs emitted to side outputs
+		Keys       int   // Distinct keys processed (reduce only)
+		BytesSaved int64 // Bytes saved by compressing the files the task produced
 	}
 
 	// The phase of the MapReduce program
@@ -49,47 +138,264 @@ const (
 	Finish
 )
 
+// Task states
+const (
+	Idle TaskState = iota
+	InProgress
+	Completed
+)
+
+func (p Phase) String() string {
+	switch p {
+	case Wait:
+		return "wait"
+	case Map:
+		return "map"
+	case MapDone:
+		return "map done"
+	case Reduce:
+		return "reduce"
+	case ReduceDone:
+		return "reduce done"
+	case Merge:
+		return "merge"
+	case Finish:
+		return "finish"
+	}
+	return fmt.Sprintf("Phase(%d)", int(p))
+}
+
+func (s TaskState) String() string {
+	switch s {
+	case Idle:
+		return "idle"
+	case InProgress:
+		return "in progress"
+	case Completed:
+		return "completed"
+	}
+	return fmt.Sprintf("TaskState(%d)", int(s))
+}
+
 // Returns next job, if there is no job then the Wait field is set to true
 func (n *Node) GetNextJob(workerAddr string) Job {
 	job := Job{
-		Phase: n.Phase,
-		Wait:  true,
+		Phase:      n.Phase,
+		Wait:       true,
+		Persistent: n.cfg.Serve || n.more,
+	}
+	if w, ok := n.Workers[workerAddr]; ok && w.Draining {
+		return job
 	}
 	switch n.Phase {
 	case Map:
-		// Map
-		if n.NextJob < M {
-			log.Printf("Map task %d assigned to [%s]\n", n.NextJob, workerAddr)
-			job.MapTask = &n.MapTasks[n.NextJob]
-			job.Wait = false
-			n.NextJob++
+		// Map, tasks whose input is on the worker first, then requeued tasks
+		if i := n.nextMapTask(workerAddr); i >= 0 {
+			n.assignMap(i, workerAddr, &job)
+			if i == n.NextJob {
+				n.NextJob++
+			}
 
-			if n.NextJob >= M {
-				n.Phase = MapDone
+			if n.nextTask(n.MapInfo) < 0 {
+				n.setPhase(MapDone)
 			}
 		}
+	case MapDone:
+		// Everything is assigned, back up a straggler
+		if i := backupCandidate(n.MapInfo, workerAddr, time.Now()); i >= 0 {
+			n.backup(Map, i, workerAddr)
+			n.MapTasks[i].Attempt = n.MapInfo[i].Attempts
+			job.MapTask = &n.MapTasks[i]
+			job.Trace = n.traceBackup(n.MapInfo[i])
+			job.Wait = false
+		}
 	case Reduce:
-		// Reduce
-		if n.NextJob < R {
-			log.Printf("Reduce task %d assigned to [%s]\n", n.NextJob, workerAddr)
-			job.ReduceTask = &n.ReduceTasks[n.NextJob]
+		// Reduce, requeued tasks first
+		if n.rerunMaps(workerAddr, &job) {
+			break
+		}
+		if i := n.nextTask(n.ReduceInfo); i >= 0 {
+			n.ReduceInfo[i].assign(workerAddr)
+			n.ReduceTasks[i].Attempt = n.ReduceInfo[i].Attempts
+			n.cfg.Logger.Info("task assigned", "phase", Reduce.String(), "task", i, "attempt", n.ReduceInfo[i].Attempts, "worker", workerAddr)
+			n.recordAssignment(Reduce, i, n.ReduceInfo[i].Attempts, workerAddr)
+			job.ReduceTask = &n.ReduceTasks[i]
+			job.Trace = n.traceTask(&n.ReduceInfo[i])
 			job.Wait = false
-			n.NextJob++
+			tasksAssigned.add(1, Reduce.String())
+			if i == n.NextJob {
+				n.NextJob++
+			}
 
-			if n.NextJob >= R {
-				n.Phase = ReduceDone
+			if n.nextTask(n.ReduceInfo) < 0 {
+				n.setPhase(ReduceDone)
 			}
 		}
+	case ReduceDone:
+		if n.rerunMaps(workerAddr, &job) {
+			break
+		}
+		if i := backupCandidate(n.ReduceInfo, workerAddr, time.Now()); i >= 0 {
+			n.backup(Reduce, i, workerAddr)
+			n.ReduceTasks[i].Attempt = n.ReduceInfo[i].Attempts
+			job.ReduceTask = &n.ReduceTasks[i]
+			job.Trace = n.traceBackup(n.ReduceInfo[i])
+			job.Wait = false
+		}
 	}
 
 	return job
 }
 
-// Start the RPC server on the node
+func (n *Node) assignMap(i int, workerAddr string, job *Job) {
+	n.MapInfo[i].assign(workerAddr)
+	n.MapTasks[i].Attempt = n.MapInfo[i].Attempts
+	n.cfg.Logger.Info("task assigned", "phase", Map.String(), "task", i, "attempt", n.MapInfo[i].Attempts, "worker", workerAddr)
+	n.recordAssignment(Map, i, n.MapInfo[i].Attempts, workerAddr)
+	job.MapTask = &n.MapTasks[i]
+	job.Trace = n.traceTask(&n.MapInfo[i])
+	job.Wait = false
+	tasksAssigned.add(1, Map.String())
+}
+
+// Assigns a map task whose files were lost in the reduce phase, if any. Returns whether map tasks are still to
+// finish, in which case reduce tasks wait as they need the files.
+func (n *Node) rerunMaps(workerAddr string, job *Job) bool {
+	if i := n.nextTask(n.MapInfo); i >= 0 {
+		n.assignMap(i, workerAddr, job)
+	}
+	for _, info := range n.MapInfo {
+		if info.State != Completed {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the task to assign next: the first requeued one, then the next one never assigned, or -1 if there is none
+func (n *Node) nextTask(infos []TaskInfo) int {
+	// Requeued tasks come before NextJob, and tasks after it may have been given out early to the worker holding
+	// their input
+	for i := range infos {
+		if infos[i].State == Idle {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns an idle map task whose input the worker wrote in an earlier stage, so shards stay in place across the
+// stages of a pipeline, or else the next task
+func (n *Node) nextMapTask(workerAddr string) int {
+	for i, task := range n.MapTasks {
+		if n.MapInfo[i].State == Idle && task.SourceHost == workerAddr {
+			return i
+		}
+	}
+	return n.nextTask(n.MapInfo)
+}
+
+// Records an assignment in the timeline, as a reassignment if an earlier attempt exists
+func (n *Node) recordAssignment(phase Phase, task, attempt int, workerAddr string) {
+	typ := TaskAssigned
+	if attempt > 1 {
+		typ = TaskReassigned
+	}
+	n.events.record(Event{Type: typ, Phase: phase.String(), Task: task, Attempt: attempt, Worker: workerAddr})
+}
+
+// Starts a span for a task attempt, returning the context the worker continues it with
+func (n *Node) traceTask(info *TaskInfo) TraceContext {
+	if n.cfg.spans == nil {
+		return TraceContext{}
+	}
+	info.SpanID = newSpanID()
+	return TraceContext{TraceID: n.cfg.spans.ctx.TraceID, ParentID: info.SpanID}
+}
+
+// Backups share the span of the attempt they race against
+func (n *Node) traceBackup(info TaskInfo) TraceContext {
+	if n.cfg.spans == nil || info.SpanID == "" {
+		return TraceContext{}
+	}
+	return TraceContext{TraceID: n.cfg.spans.ctx.TraceID, ParentID: info.SpanID}
+}
+
+// Records the span of a finished task attempt along with the spans the worker sent back
+func (n *Node) traceDone(info TaskInfo, result JobDone) {
+	if n.cfg.spans == nil || info.SpanID == "" {
+		return
+	}
+	name := fmt.Sprintf("%s %d", result.Phase, result.Number)
+	if result.Stage != "" {
+		name = result.Stage + " " + name
+	}
+	n.cfg.spans.add(Span{
+		TraceID:  n.cfg.spans.ctx.TraceID,
+		ID:       info.SpanID,
+		ParentID: n.cfg.spans.ctx.ParentID,
+		Name:     name,
+		Host:     result.Addr,
+		Start:    info.Started,
+		Duration: info.Finished.Sub(info.Started),
+		Args:     map[string]any{"attempt": info.Attempts},
+	})
+	n.cfg.spans.add(result.Spans...)
+}
+
+// Starts a speculative attempt of a running task on another worker. The first attempt to finish wins.
+func (n *Node) backup(phase Phase, task int, workerAddr string) {
+	info := n.taskInfo(phase, task)
+	info.Attempts++
+	n.cfg.Logger.Info("speculative backup assigned", "phase", phase.String(), "task", task, "attempt", info.Attempts, "worker", workerAddr, "running_on", info.Worker, "replaces", info.Backup, "stuck", info.Stuck, "done", info.Done, "total", info.Total)
+	// A stuck backup is abandoned for the new one, which gets a stuck timeout of its own
+	info.Backup, info.BackupDone = workerAddr, 0
+	info.Stuck, info.Progressed = false, time.Now()
+	n.events.record(Event{Type: TaskReassigned, Phase: phase.String(), Task: task, Attempt: info.Attempts, Worker: workerAddr, Detail: "speculative backup"})
+	tasksAssigned.add(1, phase.String())
+}
+
+func (t *TaskInfo) assign(workerAddr string) {
+	t.State = InProgress
+	t.Worker = workerAddr
+	t.Attempts++
+	t.Started = time.Now()
+	t.Progressed = t.Started
+	// Attempts of a requeued task are gone
+	t.Done, t.Stuck = 0, false
+	t.Backup, t.BackupDone = "", 0
+}
+
+func (t *TaskInfo) complete(workerAddr string) {
+	t.State = Completed
+	t.Worker = workerAddr
+	t.Finished = time.Now()
+}
+
+// Records that a worker made contact
+func (n *Node) seen(workerAddr string) {
+	if w, ok := n.Workers[workerAddr]; ok {
+		w.LastSeen = time.Now()
+	}
+}
+
+// Wakes up waitForJobs without blocking the actor, which waitForJobs needs to go on
+func (n *Node) wakeUp() {
+	select {
+	case n.wake <- struct{}{}:
+	default:
+		// A wake-up is already pending
+	}
+}
+
+// Start the RPC server on the node, served by the node's HTTP server
 func (n *Node) startRPC() (NodeActor, error) {
 	actor := n.startActor()
-	rpc.Register(actor)
-	rpc.HandleHTTP()
+	server := rpc.NewServer()
+	if err := server.Register(actor); err != nil {
+		return nil, err
+	}
+	n.cfg.mux.Handle(rpc.DefaultRPCPath, server)
 	return actor, nil
 }
 
@@ -115,8 +421,13 @@ func (a NodeActor) run(f handler) {
 }
 
 // The RPC call
-func call(address string, method string, request interface{}, reply interface{}) error {
-	client, err := rpc.DialHTTP("tcp", string(address))
+func (cfg *Config) call(address string, method string, request interface{}, reply interface{}) error {
+	start := time.Now()
+	defer func() {
+		rpcDuration.observe(time.Since(start).Seconds(), method)
+	}()
+
+	client, err := cfg.dialRPC(address)
 	if err != nil {
 		return err
 	}
@@ -133,13 +444,10 @@ func call(address string, method string, request interface{}, reply interface{})
 // Ping connects a worker to the master
 func (a NodeActor) Ping(addr string, wait *bool) error {
 	a.run(func(n *Node) {
-		log.Printf("worker connected from %s\n", addr)
-		n.Workers[addr] = struct{}{}
-		if n.Phase == Wait {
-			*wait = true
-		} else {
-			*wait = false
-		}
+		n.cfg.Logger.Info("worker connected", "worker", addr)
+		n.Workers[addr] = &WorkerInfo{LastSeen: time.Now()}
+		n.events.record(Event{Type: WorkerJoined, Task: -1, Worker: addr})
+		*wait = n.cfg.Wait && n.Phase == Wait
 	})
 	return nil
 }
@@ -156,6 +464,7 @@ func (a NodeActor) Signal(_ struct{}, _ *struct{}) error {
 func (a NodeActor) RequestJob(workerAddr string, job *Job) error {
 	var err error
 	a.run(func(n *Node) {
+		n.seen(workerAddr)
 		*job = n.GetNextJob(workerAddr)
 	})
 	return err
@@ -163,8 +472,78 @@ func (a NodeActor) RequestJob(workerAddr string, job *Job) error {
 
 func (a NodeActor) FinishJob(job JobDone, _ *struct{}) error {
 	a.run(func(n *Node) {
+		n.seen(job.Addr)
+		// Late attempts of a job that already ended would never be collected
+		if job.Job != n.JobID || job.Stage != n.Stage || n.Phase < Map || n.Phase > ReduceDone {
+			n.cfg.Logger.Info("ignoring task completion", "task_job", job.Job, "task_stage", job.Stage, "phase", job.Phase.String(), "task", job.Number, "worker", job.Addr, "current_phase", n.Phase.String())
+			return
+		}
 		n.Done <- job
 	})
 
 	return nil
 }
+
+// A worker reports a failed task attempt, which is assigned again unless another attempt is still running
+func (a NodeActor) FailJob(f TaskFailure, _ *struct{}) error {
+	a.run(func(n *Node) {
+		n.seen(f.Addr)
+		info := n.taskInfo(f.Phase, f.Number)
+		if f.Job != n.JobID || f.Stage != n.Stage || n.canceled || n.failed != nil || info == nil || info.State != InProgress {
+			n.cfg.Logger.Info("ignoring task failure", "task_job", f.Job, "task_stage", f.Stage, "phase", f.Phase.String(), "task", f.Number, "worker", f.Addr, "err", f.Error)
+			return
+		}
+		n.cfg.Logger.Warn("task failed", "phase", f.Phase.String(), "task", f.Number, "attempt", f.Attempt, "worker", f.Addr, "err", f.Error)
+		n.events.record(Event{Type: TaskFailed, Phase: f.Phase.String(), Task: f.Number, Attempt: f.Attempt, Worker: f.Addr, Detail: f.Error})
+		info.Failures = append(info.Failures, FailedAttempt{Attempt: f.Attempt, Worker: f.Addr, Time: time.Now(), Error: f.Error})
+		if len(info.Failures) >= maxTaskFailures {
+			n.cfg.Logger.Error("task failed too many times, failing the job", "phase", f.Phase.String(), "task", f.Number, "failures", len(info.Failures))
+			n.failed = fmt.Errorf("%s task %d failed %d times, last on %s: %s", f.Phase, f.Number, len(info.Failures), f.Addr, f.Error)
+			n.setPhase(Wait)
+			n.wakeUp()
+			return
+		}
+		n.dropAttempt(f.Phase, f.Number, f.Addr, "task failed")
+		if f.Unreachable != "" && f.Unreachable != f.Addr {
+			n.requeueLost(f.Unreachable)
+		}
+	})
+	return nil
+}
+
+// A worker reports a download that kept failing verification. The map task that wrote the file is assigned again.
+func (a NodeActor) ReportCorruption(c Corruption, _ *struct{}) error {
+	a.run(func(n *Node) {
+		n.cfg.Logger.Warn("worker reported corrupt download", "worker", c.Addr, "url", c.URL, "expected_size", c.Expected.Size, "expected_sha256", c.Expected.SHA256, "size", c.Got.Size, "sha256", c.Got.SHA256)
+		n.Corruptions = append(n.Corruptions, c)
+		n.events.record(Event{Type: FileCorrupted, Task: -1, Worker: c.Addr, Detail: c.URL})
+		if n.canceled || n.failed != nil || n.Phase < Map || n.Phase > ReduceDone {
+			return
+		}
+		if i := n.mapTaskOf(c.URL); i >= 0 {
+			n.redo(Map, i, "corrupt output")
+		}
+	})
+	return nil
+}
+
+// Returns the completed map task of the current stage whose output is at url, or -1 if there is none
+func (n *Node) mapTaskOf(fileURL string) int {
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return -1
+	}
+	file := strings.TrimPrefix(u.Path, "/data/")
+	for i := range n.MapTasks {
+		task := &n.MapTasks[i]
+		if n.MapInfo[i].State != Completed || n.MapInfo[i].Worker != u.Host {
+			continue
+		}
+		for r := 0; r < task.partitions(); r++ {
+			if task.outputFile(r) == file {
+				return i
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,157 @@
+package mapreduce
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+)
+
+const (
+	tokenEnv = "MAPREDUCE_TOKEN" // Environment variable used as the default for -token
+
+	rpcConnected = "200 Connected to Go RPC" // Status net/rpc answers a CONNECT with
+)
+
+// Loads certificates and builds the TLS configurations from the TLS files
+func (cfg *Config) setupSecurity() error {
+	cfg.httpClient = http.DefaultClient
+	if cfg.TLSCert == "" && cfg.TLSKey == "" {
+		if cfg.TLSCA != "" {
+			return errors.New("-tls-ca requires -tls-cert and -tls-key")
+		}
+		return nil
+	}
+	if cfg.TLSCert == "" || cfg.TLSKey == "" {
+		return errors.New("-tls-cert and -tls-key must be given together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return fmt.Errorf("loading key pair: %v", err)
+	}
+	serverTLS := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	clientTLS := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	// With a CA, peers must present certificates signed by it in both directions (mTLS)
+	if cfg.TLSCA != "" {
+		pem, err := os.ReadFile(cfg.TLSCA)
+		if err != nil {
+			return fmt.Errorf("reading CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", cfg.TLSCA)
+		}
+		serverTLS.ClientCAs = pool
+		serverTLS.ClientAuth = tls.RequireAndVerifyClientCert
+		clientTLS.RootCAs = pool
+	}
+
+	cfg.serverTLS = serverTLS
+	cfg.clientTLS = clientTLS
+	cfg.httpClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: clientTLS,
+		},
+	}
+	return nil
+}
+
+// Rejects requests that don't carry the shared token (if one is configured)
+func (cfg *Config) authHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.Token != "" {
+			got := r.Header.Get("Authorization")
+			if subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+cfg.Token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Adds the shared token to an outgoing request
+func (cfg *Config) authorize(req *http.Request) {
+	if cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.Token)
+	}
+}
+
+// Connects to the RPC server at address like rpc.DialHTTP, but over TLS and with the token when configured
+func (cfg *Config) dialRPC(address string) (*rpc.Client, error) {
+	dial := cfg.Dial
+	if dial == nil {
+		dial = net.Dial
+	}
+	conn, err := dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.clientTLS != nil {
+		tlsCfg := cfg.clientTLS.Clone()
+		if tlsCfg.ServerName, _, err = net.SplitHostPort(address); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tls.Client(conn, tlsCfg)
+	}
+
+	header := ""
+	if cfg.Token != "" {
+		header = "Authorization: Bearer " + cfg.Token + "\r\n"
+	}
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\r\n"+header+"\r\n")
+
+	// Require successful HTTP response before switching to RPC protocol
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err == nil && resp.Status == rpcConnected {
+		return rpc.NewClient(conn), nil
+	}
+	if err == nil {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	conn.Close()
+	return nil, fmt.Errorf("connecting to %s: %v", address, err)
+}
+
+// Serves handler at host (or on cfg.Listener if set), over TLS when configured
+func (cfg *Config) listenAndServe(host string, handler http.Handler) error {
+	server := &http.Server{
+		Addr:      host,
+		Handler:   cfg.authHandler(handler),
+		TLSConfig: cfg.serverTLS,
+	}
+	switch {
+	case cfg.Listener != nil && cfg.serverTLS != nil:
+		return server.ServeTLS(cfg.Listener, "", "")
+	case cfg.Listener != nil:
+		return server.Serve(cfg.Listener)
+	case cfg.serverTLS != nil:
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// Scheme for the data URLs
+func (cfg *Config) scheme() string {
+	if cfg.serverTLS != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,205 @@
+package mapreduce
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type Echoer struct{}
+
+func (Echoer) Echo(s string, reply *string) error {
+	*reply = s
+	return nil
+}
+
+// Serves an Echo RPC and the files in dir with the security settings of cfg, returning the address
+func serveSecure(t *testing.T, cfg *Config, dir string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := rpc.NewServer()
+	if err := server.Register(Echoer{}); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, server)
+	mux.Handle("/data/", http.StripPrefix("/data", dataHandler(cfg.Logger, dir)))
+	cfg.Listener = listener
+	go cfg.listenAndServe("", mux)
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return "localhost:" + port
+}
+
+func testConfig(t *testing.T, cfg Config) *Config {
+	t.Helper()
+	cfg.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := cfg.setup(); err != nil {
+		t.Fatal(err)
+	}
+	return &cfg
+}
+
+func TestAuthHandler(t *testing.T) {
+	cfg := &Config{Token: "secret"}
+	handler := cfg.authHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"missing token", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer guess", http.StatusUnauthorized},
+		{"token without scheme", "secret", http.StatusUnauthorized},
+		{"right token", "Bearer secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/data/x", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("got status %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestDialRPCSendsToken(t *testing.T) {
+	addr := serveSecure(t, testConfig(t, Config{Token: "secret"}), t.TempDir())
+
+	var reply string
+	if err := testConfig(t, Config{Token: "secret"}).call(addr, "Echoer.Echo", "hi", &reply); err != nil {
+		t.Fatalf("call with the token: %v", err)
+	}
+	if reply != "hi" {
+		t.Errorf("got reply %q, want hi", reply)
+	}
+	for _, token := range []string{"", "guess"} {
+		err := testConfig(t, Config{Token: token}).call(addr, "Echoer.Echo", "hi", &reply)
+		if err == nil || !strings.Contains(err.Error(), "401") {
+			t.Errorf("call with token %q: got error %v, want a 401", token, err)
+		}
+	}
+}
+
+// Writes a CA and a certificate it signed for localhost into dir, returning the CA, cert and key files
+func writeCerts(t *testing.T, dir string) (string, string, string) {
+	t.Helper()
+	writePEM := func(name, kind string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	caKey := newKey()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mapreduce test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nodes use the same certificate as servers and clients
+	key := newKey()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writePEM("ca.pem", "CERTIFICATE", caDER), writePEM("cert.pem", "CERTIFICATE", der), writePEM("key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, cert, key := writeCerts(t, t.TempDir())
+	if err := os.WriteFile(filepath.Join(dir, "part.db"), []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := Config{TLSCert: cert, TLSKey: key, TLSCA: ca, Token: "secret"}
+	addr := serveSecure(t, testConfig(t, tlsConfig), dir)
+	client := testConfig(t, tlsConfig)
+
+	var reply string
+	if err := client.call(addr, "Echoer.Echo", "hi", &reply); err != nil {
+		t.Fatalf("RPC over mTLS: %v", err)
+	}
+	if reply != "hi" {
+		t.Errorf("got reply %q, want hi", reply)
+	}
+
+	dest := filepath.Join(t.TempDir(), "part.db")
+	if err := client.download(client.makeURL(addr, "part.db"), dest); err != nil {
+		t.Fatalf("download over mTLS: %v", err)
+	}
+	if data, _ := os.ReadFile(dest); string(data) != "data" {
+		t.Errorf("downloaded %q, want data", data)
+	}
+
+	// Without a certificate signed by the CA the handshake fails
+	plain := testConfig(t, Config{Token: "secret"})
+	if err := plain.call(addr, "Echoer.Echo", "hi", &reply); err == nil {
+		t.Error("RPC without TLS succeeded")
+	}
+	_, otherCert, otherKey := writeCerts(t, t.TempDir())
+	stranger := testConfig(t, Config{TLSCert: otherCert, TLSKey: otherKey, TLSCA: ca, Token: "secret"})
+	if err := stranger.call(addr, "Echoer.Echo", "hi", &reply); err == nil {
+		t.Error("RPC with a certificate of another CA succeeded")
+	}
+}
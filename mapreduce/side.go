@@ -0,0 +1,215 @@
+package mapreduce
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Names of side outputs, which become table names in the output db. SQLite table names ignore case, so only lower
+// case names are allowed.
+var outputNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+type (
+	// Files of the named outputs a task emitted to, created on first use
+	sideOutputs struct {
+		mu      sync.Mutex
+		tempdir string
+		file    func(name string) string // Task file holding the named output
+		dbs     map[string]*sql.DB
+		stmts   map[string]*sql.Stmt
+		count   int // Pairs emitted to all named outputs
+	}
+)
+
+func newSideOutputs(tempdir string, file func(name string) string) *sideOutputs {
+	return &sideOutputs{
+		tempdir: tempdir,
+		file:    file,
+		dbs:     make(map[string]*sql.DB),
+		stmts:   make(map[string]*sql.Stmt),
+	}
+}
+
+// Emit writes a pair to the named side output of the job, which becomes a table of that name in the output db.
+// Names start with a lower case letter followed by lower case letters, digits or underscores, and don't end in
+// "_key", which names the indexes of -output-index; "pairs" is the main output.
+// Pairs emitted by map tasks skip the reduce phase. Safe for concurrent use.
+func (ctx *TaskContext) Emit(name string, pair Pair) error {
+	if ctx.sides == nil {
+		return errors.New("side outputs are only available in map and reduce tasks")
+	}
+	return ctx.sides.write(name, pair)
+}
+
+func validOutputName(name string) bool {
+	return outputNameRegexp.MatchString(name) && name != "pairs" && !strings.HasPrefix(name, "sqlite_") && !strings.HasSuffix(name, "_key")
+}
+
+func (s *sideOutputs) write(name string, pair Pair) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stmt, ok := s.stmts[name]
+	if !ok {
+		if !validOutputName(name) {
+			return fmt.Errorf("invalid output name %q", name)
+		}
+		db, err := createDatabase(filepath.Join(s.tempdir, s.file(name)))
+		if err != nil {
+			return fmt.Errorf("creating side output %s: %v", name, err)
+		}
+		if stmt, err = db.Prepare("INSERT INTO pairs (key, value) values (?, ?)"); err != nil {
+			db.Close()
+			return fmt.Errorf("preparing insert statement: %v", err)
+		}
+		s.dbs[name], s.stmts[name] = db, stmt
+	}
+	if _, err := stmt.Exec(pair.Key, pair.Value); err != nil {
+		return fmt.Errorf("inserting into side output %s: %v", name, err)
+	}
+	s.count++
+	return nil
+}
+
+// Closes the files of the named outputs, then checksums and compresses them so they can be served. Their names
+// and checksums are added to the task result.
+func (s *sideOutputs) finish(compression string, result *JobDone) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, db := range s.dbs {
+		s.stmts[name].Close()
+		if err := db.Close(); err != nil {
+			return fmt.Errorf("closing side output %s: %v", name, err)
+		}
+		delete(s.dbs, name)
+		file := s.file(name)
+		path := filepath.Join(s.tempdir, file)
+		sum, err := sumFile(path)
+		if err != nil {
+			return fmt.Errorf("checksumming side output %s: %v", name, err)
+		}
+		result.Files[file] = sum
+		saved, err := compressFile(path, compression)
+		if err != nil {
+			return fmt.Errorf("compressing side output %s: %v", name, err)
+		}
+		result.Stats.BytesSaved += saved
+		result.Sides = append(result.Sides, name)
+	}
+	sort.Strings(result.Sides)
+	result.Stats.SidePairs = s.count
+	return nil
+}
+
+// Closes whatever files are still open, e.g. after the task failed
+func (s *sideOutputs) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, db := range s.dbs {
+		s.stmts[name].Close()
+		db.Close()
+	}
+}
+
+// Adds the side output files of a stage's tasks to parts, by output name
+func addSideParts(parts map[string][]outputPart, mapTasks []MapTask, reduceTasks []ReduceTask, mapResults, reduceResults []JobDone) {
+	for i, result := range mapResults {
+		for _, name := range result.Sides {
+			file := mapTasks[i].sideFile(name)
+			parts[name] = append(parts[name], outputPart{Host: result.Addr, File: file, Sum: result.Files[file]})
+		}
+	}
+	for i, result := range reduceResults {
+		for _, name := range result.Sides {
+			file := reduceTasks[i].sideFile(name)
+			parts[name] = append(parts[name], outputPart{Host: result.Addr, File: file, Sum: result.Files[file]})
+		}
+	}
+}
+
+const copySideCmd = `ATTACH ? AS side;
+CREATE TABLE %[1]s (key text, value text);
+INSERT INTO %[1]s SELECT key, value FROM side.pairs ORDER BY rowid;
+DETACH side;`
+
+// Merges the side outputs into tables of the output db at dest, using dir for temporary files. Tables are
+// sorted and indexed like the main output.
+func (cfg *Config) mergeSideOutputs(parts map[string][]outputPart, dest string, dir string) error {
+	if len(parts) == 0 {
+		return nil
+	}
+	// Names come from workers and go into SQL, so they are checked again
+	for name := range parts {
+		if !validOutputName(name) {
+			return fmt.Errorf("invalid side output name %q", name)
+		}
+	}
+	out, err := openDatabase(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	names := make([]string, 0, len(parts))
+	for name := range parts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	merge := *cfg
+	merge.OutputIndex = false
+	for _, name := range names {
+		urls, sums := cfg.partURLs(parts[name])
+		merged := filepath.Join(dir, "side.db")
+		if err := merge.mergeOutput(urls, sums, merged, dir); err != nil {
+			return fmt.Errorf("merging side output %s: %v", name, err)
+		}
+		if _, err := out.Exec(fmt.Sprintf(copySideCmd, name), merged); err != nil {
+			return fmt.Errorf("copying side output %s: %v", name, err)
+		}
+		if err := os.Remove(merged); err != nil {
+			return fmt.Errorf("removing merged side output: %v", err)
+		}
+		if cfg.OutputIndex {
+			if _, err := out.Exec(fmt.Sprintf("CREATE INDEX %[1]s_key ON %[1]s (key)", name)); err != nil {
+				return fmt.Errorf("indexing side output %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ReadSideOutputs returns the tables of an output db other than the main output, by name, each sorted by key and
+// then value
+func ReadSideOutputs(path string) (map[string][]Pair, error) {
+	db, err := openDatabase(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name != 'pairs'")
+	if err != nil {
+		return nil, fmt.Errorf("listing tables: %v", err)
+	}
+	defer rows.Close()
+
+	sides := make(map[string][]Pair)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("reading table name: %v", err)
+		}
+		if sides[name], err = readTable(path, name); err != nil {
+			return nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("listing tables: %v", err)
+	}
+	return sides, nil
+}
@@ -0,0 +1,141 @@
+package mapreduce
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const sortCollation = "mapreduce_sort" // Registered on the connection sorting a reduce input with a SortComparator
+
+type (
+	// SortComparator can be implemented by clients that order the input of their reduce tasks themselves, e.g. by a
+	// timestamp embedded in the value. SortCompare returns a negative number when a comes before b, 0 when they are
+	// equivalent and a positive number otherwise. Pairs that are grouped into one Reduce call must end up next to
+	// each other, so compare keys (or their group) first. By default pairs are ordered by key, then value.
+	SortComparator interface {
+		SortCompare(a, b Pair) int
+	}
+
+	// GroupingComparator can be implemented by clients whose Reduce calls span several keys, e.g. composite keys
+	// grouped by a prefix. Consecutive keys in sort order for which GroupCompare returns 0 go to one Reduce call,
+	// which gets the first of them as its key. By default only equal keys are grouped.
+	// Implement Partitioner as well so every key of a group goes to the same reduce task.
+	GroupingComparator interface {
+		GroupCompare(a, b string) int
+	}
+
+	// Partitioner can be implemented by clients that choose the reduce task of each map output key.
+	// Partition returns a number from 0 to r-1. By default keys are spread by their FNV-1 hash.
+	Partitioner interface {
+		Partition(key string, r int) int
+	}
+
+	// Wrapper can be implemented by clients that wrap another client, so the optional hooks of the wrapped client
+	// (SortComparator, GroupingComparator, Partitioner and the setup and cleanup methods) are found through them
+	Wrapper interface {
+		Unwrap() Interface
+	}
+)
+
+// Returns the first client in the chain of wrapped clients that implements T
+func findHook[T any](client Interface) (T, bool) {
+	for client != nil {
+		if hook, ok := client.(T); ok {
+			return hook, true
+		}
+		w, ok := client.(Wrapper)
+		if !ok {
+			break
+		}
+		client = w.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
+
+// Returns the reduce task number of map output keys. A panic of the client's Partition is returned as an error.
+func partitionFunc(client Interface, r int) func(key string) (int, error) {
+	if p, ok := findHook[Partitioner](client); ok {
+		return func(key string) (part int, err error) {
+			defer func() {
+				if rec := recover(); rec != nil {
+					err = fmt.Errorf("partition panicked on key %q: %v", key, rec)
+				}
+			}()
+			return p.Partition(key, r), nil
+		}
+	}
+	return func(key string) (int, error) {
+		hash := fnv.New32() // from the stdlib package hash/fnv
+		hash.Write([]byte(key))
+		return int(hash.Sum32() % uint32(r)), nil
+	}
+}
+
+// Returns whether consecutive keys of a reduce input go to the same Reduce call. A panic of the client's
+// GroupCompare is returned as an error.
+func groupFunc(client Interface) func(a, b string) (bool, error) {
+	if g, ok := findHook[GroupingComparator](client); ok {
+		return func(a, b string) (same bool, err error) {
+			defer func() {
+				if rec := recover(); rec != nil {
+					err = fmt.Errorf("group comparator panicked on keys %q and %q: %v", a, b, rec)
+				}
+			}()
+			return g.GroupCompare(a, b) == 0, nil
+		}
+	}
+	return func(a, b string) (bool, error) {
+		return a == b, nil
+	}
+}
+
+// Sorts the pairs table into a new table on conn with the client's comparator, through a collation over the
+// pairs encoded as <key length>:<key><value>, and returns them in order
+func sortWithComparator(conn *sql.Conn, sorter SortComparator) (*sql.Rows, error) {
+	ctx := context.Background()
+	// A panic can't unwind through SQLite, so it is kept and returned once the sort is over
+	var panicked any
+	err := conn.Raw(func(driverConn any) error {
+		return driverConn.(*sqlite3.SQLiteConn).RegisterCollation(sortCollation, func(a, b string) (c int) {
+			if panicked != nil {
+				return 0
+			}
+			defer func() {
+				if rec := recover(); rec != nil {
+					panicked = rec
+				}
+			}()
+			return sorter.SortCompare(decodeSortKey(a), decodeSortKey(b))
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("registering sort collation: %v", err)
+	}
+
+	sortCmd := fmt.Sprintf(`CREATE TABLE sorted AS SELECT key, value FROM pairs
+ORDER BY length(CAST(key AS BLOB)) || ':' || key || value COLLATE %s`, sortCollation)
+	if _, err := conn.ExecContext(ctx, sortCmd); err != nil {
+		return nil, fmt.Errorf("sorting with comparator: %v", err)
+	}
+	if panicked != nil {
+		return nil, fmt.Errorf("sort comparator panicked: %v", panicked)
+	}
+	return conn.QueryContext(ctx, "SELECT key, value FROM sorted ORDER BY rowid")
+}
+
+// Decodes a pair encoded by the sort command
+func decodeSortKey(s string) Pair {
+	length, rest, _ := strings.Cut(s, ":")
+	n, _ := strconv.Atoi(length)
+	if n > len(rest) {
+		n = len(rest)
+	}
+	return Pair{Key: rest[:n], Value: rest[n:]}
+}
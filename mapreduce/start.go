@@ -4,10 +4,9 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
 	"os"
-	"path/filepath"
 	"runtime"
 )
 
@@ -23,89 +22,134 @@ type (
 	}
 )
 
-var (
-	master     bool
-	wait       bool
-	masterAddr string
-	port       string
-	tempdir    string
-	M          int
-	R          int
-	mode       string // Part1/Part2/Main flags
-
-	host string
-)
-
 func Start(client Interface) error {
+	return start(func(cfg *Config) []Stage {
+		return []Stage{{Client: client, R: cfg.R}}
+	})
+}
+
+// StartPipeline is Start for a pipeline of stages, see RunPipeline. -M applies to the first stage and each
+// stage sets its own R.
+func StartPipeline(stages ...Stage) error {
+	return start(func(*Config) []Stage {
+		return stages
+	})
+}
+
+// StartIterative is Start for an iterative job, see RunIterative
+func StartIterative(job IterativeJob) error {
+	if job.MaxIterations <= 0 {
+		return errors.New("an iterative job needs a positive MaxIterations")
+	}
+	return start(func(*Config) []Stage {
+		return job.Stages()
+	})
+}
+
+// Parses the flags, then runs a node with the stages built from them or a subcommand
+func start(stages func(cfg *Config) []Stage) error {
 	runtime.GOMAXPROCS(1)
-	log.SetFlags(log.Lshortfile)
 
-	flag.BoolVar(&master, "master", false, "Whether this node is the master or a worker")
-	flag.BoolVar(&wait, "wait", false, "Should workers wait for a master signal (keypress) or start immediately upon joining")
-	flag.StringVar(&masterAddr, "address", "localhost:8080", "Address of the master node")
+	cfg := DefaultConfig()
+	var port, mode, logLevel, logFormat, timelineFormat string
+
+	flag.BoolVar(&cfg.Master, "master", false, "Whether this node is the master or a worker")
+	flag.BoolVar(&cfg.Serve, "serve", false, "Run the master as a coordinator that runs submitted jobs until killed")
+	flag.BoolVar(&cfg.Wait, "wait", false, "Should workers wait for a master signal (keypress) or start immediately upon joining")
+	flag.StringVar(&cfg.MasterAddr, "address", cfg.MasterAddr, "Address of the master node")
 	flag.StringVar(&port, "port", "8080", "The port to listen on")
-	flag.StringVar(&tempdir, "tempdir", filepath.Join("tmp", fmt.Sprintf("mapreduce.%d", os.Getpid())), "The directory to store temporary files in")
+	flag.StringVar(&cfg.Tempdir, "tempdir", cfg.Tempdir, "The directory to store temporary files in")
+
+	flag.IntVar(&cfg.M, "M", cfg.M, "Number of map tasks")
+	flag.IntVar(&cfg.R, "R", cfg.R, "Number of reduce tasks, 0 for a map-only job")
+
+	flag.DurationVar(&cfg.StuckTimeout, "stuck-timeout", cfg.StuckTimeout, "Back up running tasks whose progress doesn't move for this long (master only)")
+
+	flag.StringVar(&cfg.Compression, "compress", cfg.Compression, "(none|gzip) Compression for intermediate and output files")
+	flag.BoolVar(&cfg.SortedOutput, "sorted-output", false, "Write the output sorted by key, then value, so identical inputs give identical files (master only)")
+	flag.BoolVar(&cfg.OutputIndex, "output-index", false, "Create an index on key in the output db (master only)")
+
+	flag.StringVar(&cfg.Token, "token", cfg.Token, "Shared secret required for RPC and data requests (default $"+tokenEnv+")")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", "", "Certificate file, enables TLS for RPC and data transfer")
+	flag.StringVar(&cfg.TLSKey, "tls-key", "", "Private key file for -tls-cert")
+	flag.StringVar(&cfg.TLSCA, "tls-ca", "", "CA certificate file used to verify peers, enables mutual TLS")
+
+	flag.Func("cache-file", "File served to every task of the job, repeat for more (master or submit)", func(path string) error {
+		cfg.CacheFiles = append(cfg.CacheFiles, path)
+		return nil
+	})
+
+	flag.BoolVar(&cfg.Trace, "trace", false, "Write a Chrome trace of the job to <OUTPUT_DB>.trace.json (master only)")
 
-	flag.IntVar(&M, "M", 10, "Number of map tasks")
-	flag.IntVar(&R, "R", 10, "Number of reduce tasks")
+	flag.StringVar(&logLevel, "log-level", "info", "(debug|info|warn|error) Minimum level of log messages")
+	flag.StringVar(&logFormat, "log-format", "text", "(text|json) Log format, text is logfmt")
 
-	flag.StringVar(&mode, "mode", "main", "(part1|part2|main) For testing")
+	flag.StringVar(&mode, "mode", "main", "(main|timeline) Run a node, or render an event log")
+	flag.StringVar(&timelineFormat, "timeline-format", "text", "(text|html) Output format of -mode timeline")
 
 	flag.Parse()
 
-	host = "localhost:" + port
+	cfg.Host = "localhost:" + port
+
+	logger, err := NewLogger(os.Stderr, logLevel, logFormat)
+	if err != nil {
+		return err
+	}
+	cfg.Logger = logger
 
 	// For serving test
 	// localServe(host, filepath.Join("tmp", fmt.Sprintf("mapreduce.%d", 244282)))
 
 	switch mode {
-	case "part1":
-		if err := part1(); err != nil {
-			return fmt.Errorf("part1: %v", err)
+	case "timeline":
+		if flag.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "USAGE: PROGRAM -mode timeline [-timeline-format html] <OUTPUT_DB>.events.jsonl")
+			return errors.New("specify the path to the event log")
 		}
-		return nil
-	case "part2":
-		if err := part2(client); err != nil {
-			return fmt.Errorf("part2: %v", err)
+		return RenderTimeline(os.Stdout, flag.Arg(0), timelineFormat)
+	}
+
+	// Subcommands talk to a running master
+	if !cfg.Master && flag.NArg() > 0 {
+		if err := cfg.setup(); err != nil {
+			return err
 		}
-		return nil
+		return runCommand(&cfg, os.Stdout, flag.Args())
 	}
 
-	if master {
-		log.Printf("Starting master node on port %s\n", port)
+	if cfg.Master && !cfg.Serve {
 		// Verify input and output db
 		if flag.NArg() != 2 {
 			fmt.Fprintln(os.Stderr, "USAGE: PROGRAM -master <INPUT_DB> <OUTPUT_DB>")
 			return errors.New("specify paths to input and output db at end")
 		}
-		inputPath := flag.Arg(0)
-		outputPath := flag.Arg(1)
-
-		if err := startMaster(client, inputPath, outputPath); err != nil {
-			return fmt.Errorf("master failure %v", err)
-		}
-	} else {
-		log.Printf("Starting worker node on port %s\n", port)
-		if masterAddr == host {
-			return fmt.Errorf("master address is same as worker (%s == %s)", masterAddr, host)
-		}
-		if err := startWorker(client); err != nil {
-			return fmt.Errorf("worker failure: %v", err)
-		}
+		cfg.InputPath = flag.Arg(0)
+		cfg.OutputPath = flag.Arg(1)
 	}
 
-	return nil
+	return RunPipeline(cfg, stages(&cfg))
 }
 
-// Serves data in tempdir over http at host
-func localServe(host, tempdir string) {
-	http.Handle("/data/", http.StripPrefix("/data", http.FileServer(http.Dir(tempdir))))
-	log.Printf("Serving %s/* at %s", tempdir, makeURL(host, "*"))
-	if err := http.ListenAndServe(host, nil); err != nil {
-		log.Fatalf("Error in HTTP server for %s: %v", host, err)
+// Run starts a master or worker node with the given config and blocks until it is done
+func Run(cfg Config, client Interface) error {
+	return RunPipeline(cfg, []Stage{{Client: client, R: cfg.R}})
+}
+
+// Serves data in tempdir over http at host, along with the routes already registered on the node's mux
+func (cfg *Config) localServe() {
+	cfg.mux.Handle("/data/", http.StripPrefix("/data", dataHandler(cfg.Logger, cfg.Tempdir)))
+	cfg.mux.Handle("/metrics", metricsHandler())
+	cfg.Logger.Info("serving files", "dir", cfg.Tempdir, "url", cfg.makeURL(cfg.Host, "*"))
+	if err := cfg.listenAndServe(cfg.Host, cfg.mux); err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			// The embedder closed cfg.Listener
+			return
+		}
+		cfg.Logger.Error("HTTP server failed", "host", cfg.Host, "err", err)
+		os.Exit(1)
 	}
 }
 
-func makeURL(host, file string) string {
-	return fmt.Sprintf("http://%s/data/%s", host, file)
+func (cfg *Config) makeURL(host, file string) string {
+	return fmt.Sprintf("%s://%s/data/%s", cfg.scheme(), host, file)
 }
@@ -0,0 +1,178 @@
+package mapreduce
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+type (
+	// Status is a snapshot of the master's view of the job
+	Status struct {
+		JobID       string `json:",omitempty"`
+		Stage       string `json:",omitempty"` // Pipeline stage
+		Phase       string
+		Started     time.Time `json:",omitempty"`
+		Elapsed     float64   // Seconds since the map phase started
+		Progress    float64   // Fraction of map and reduce tasks completed
+		ETA         float64   // Estimated seconds until all tasks are completed, -1 if unknown
+		MapTasks    []TaskStatus
+		ReduceTasks []TaskStatus
+		Workers     []WorkerStatus
+	}
+
+	TaskStatus struct {
+		Number   int
+		State    string
+		Worker   string `json:",omitempty"`
+		Attempts int
+		Duration float64 // Seconds spent in progress (so far, if still running)
+		Progress float64 // Fraction of the task's rows processed, -1 if unknown
+		Stuck    bool    `json:",omitempty"`
+		Backup   string  `json:",omitempty"` // Worker running a speculative backup
+	}
+
+	WorkerStatus struct {
+		Addr     string
+		LastSeen time.Time
+		Idle     float64  // Seconds since the worker was last seen
+		Draining bool     `json:",omitempty"`
+		Tasks    []string `json:",omitempty"` // Tasks the worker is running
+	}
+)
+
+// Registers the status page and its JSON equivalent on mux
+func handleStatus(mux *http.ServeMux, actor NodeActor, logger *slog.Logger) {
+	mux.HandleFunc("/status.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(actor.status()); err != nil {
+			logger.Warn("error encoding status", "err", err)
+		}
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := statusPage.Execute(w, actor.status()); err != nil {
+			logger.Warn("error rendering status", "err", err)
+		}
+	})
+}
+
+// Takes a snapshot of the node
+func (a NodeActor) status() Status {
+	var status Status
+	a.run(func(n *Node) {
+		status = n.status(time.Now())
+	})
+	return status
+}
+
+func (n *Node) status(now time.Time) Status {
+	status := Status{
+		JobID:       n.JobID,
+		Stage:       n.Stage,
+		Phase:       n.Phase.String(),
+		Started:     n.Started,
+		ETA:         -1,
+		MapTasks:    taskStatuses(n.MapInfo, now),
+		ReduceTasks: taskStatuses(n.ReduceInfo, now),
+	}
+
+	total, done := len(n.MapInfo)+len(n.ReduceInfo), completed(n.MapInfo)+completed(n.ReduceInfo)
+	if total > 0 {
+		status.Progress = float64(done) / float64(total)
+	}
+	if !n.Started.IsZero() {
+		status.Elapsed = now.Sub(n.Started).Seconds()
+		// Assume the remaining tasks run at the average rate so far
+		if done > 0 {
+			status.ETA = status.Elapsed / float64(done) * float64(total-done)
+		}
+	}
+
+	for addr, worker := range n.Workers {
+		status.Workers = append(status.Workers, WorkerStatus{
+			Addr:     addr,
+			LastSeen: worker.LastSeen,
+			Idle:     now.Sub(worker.LastSeen).Seconds(),
+			Draining: worker.Draining,
+			Tasks:    n.workerTasks(addr),
+		})
+	}
+	sort.Slice(status.Workers, func(i, j int) bool {
+		return status.Workers[i].Addr < status.Workers[j].Addr
+	})
+
+	return status
+}
+
+func completed(infos []TaskInfo) int {
+	count := 0
+	for _, info := range infos {
+		if info.State == Completed {
+			count++
+		}
+	}
+	return count
+}
+
+func taskStatuses(infos []TaskInfo, now time.Time) []TaskStatus {
+	statuses := make([]TaskStatus, len(infos))
+	for i, info := range infos {
+		statuses[i] = TaskStatus{
+			Number:   i,
+			State:    info.State.String(),
+			Worker:   info.Worker,
+			Attempts: info.Attempts,
+			Progress: info.fraction(),
+			Stuck:    info.Stuck,
+			Backup:   info.Backup,
+		}
+		switch info.State {
+		case InProgress:
+			statuses[i].Duration = now.Sub(info.Started).Seconds()
+		case Completed:
+			statuses[i].Duration = info.Finished.Sub(info.Started).Seconds()
+		}
+	}
+	return statuses
+}
+
+var statusPage = template.Must(template.New("status").Funcs(template.FuncMap{
+	"percent": func(f float64) string { return fmt.Sprintf("%.1f%%", f*100) },
+	"seconds": func(f float64) string {
+		return (time.Duration(f * float64(time.Second))).Round(time.Second / 10).String()
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>MapReduce status</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+</style>
+</head>
+<body>
+<h1>MapReduce{{if .JobID}} {{.JobID}}{{end}}: {{.Phase}}</h1>
+<p>Progress {{percent .Progress}}, elapsed {{seconds .Elapsed}}, ETA {{if lt .ETA 0.0}}unknown{{else}}{{seconds .ETA}}{{end}} (<a href="/status.json">json</a>)</p>
+<h2>Map tasks</h2>
+{{template "tasks" .MapTasks}}
+<h2>Reduce tasks</h2>
+{{template "tasks" .ReduceTasks}}
+<h2>Workers</h2>
+<table>
+<tr><th>Address</th><th>Last seen</th><th>Tasks</th></tr>
+{{range .Workers}}<tr><td>{{.Addr}}{{if .Draining}} (draining){{end}}</td><td>{{seconds .Idle}} ago</td><td>{{range .Tasks}}{{.}} {{end}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+{{define "tasks"}}<table>
+<tr><th>#</th><th>State</th><th>Worker</th><th>Progress</th><th>Duration</th></tr>
+{{range .}}<tr><td>{{.Number}}</td><td>{{.State}}{{if .Stuck}} (stuck){{end}}</td><td>{{.Worker}}{{if .Backup}}, backup on {{.Backup}}{{end}}</td><td>{{if ge .Progress 0.0}}{{percent .Progress}}{{end}}</td><td>{{if .Worker}}{{seconds .Duration}}{{end}}</td></tr>
+{{end}}</table>{{end}}`))
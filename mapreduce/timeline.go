@@ -0,0 +1,202 @@
+package mapreduce
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+const timelineWidth = 60 // Columns of the text Gantt chart
+
+type (
+	// A span of time a worker spent on one task attempt
+	timelineBar struct {
+		Label  string
+		Start  time.Duration // Relative to the first event
+		End    time.Duration
+		Result string // finished, failed, requeued or running (never finished)
+	}
+
+	timelineRow struct {
+		Worker string
+		Bars   []timelineBar
+	}
+
+	timelineMark struct {
+		Label string
+		At    time.Duration
+	}
+
+	// Events grouped per worker, ready to render
+	timeline struct {
+		Total  time.Duration
+		Rows   []timelineRow
+		Phases []timelineMark
+	}
+)
+
+// Builds per worker bars from an event log
+func buildTimeline(events []Event) timeline {
+	var tl timeline
+	if len(events) == 0 {
+		return tl
+	}
+	start := events[0].Time
+	tl.Total = events[len(events)-1].Time.Sub(start)
+
+	type attempt struct {
+		stage, phase  string
+		task, attempt int
+	}
+	type location struct {
+		worker string
+		index  int
+	}
+	open := make(map[attempt]location) // Bars of attempts that haven't finished yet
+	bars := make(map[string][]timelineBar)
+	var workers []string
+
+	addWorker := func(worker string) {
+		if _, ok := bars[worker]; !ok {
+			bars[worker] = nil
+			workers = append(workers, worker)
+		}
+	}
+
+	for _, e := range events {
+		at := e.Time.Sub(start)
+		key := attempt{e.Stage, e.Phase, e.Task, e.Attempt}
+		label := e.Phase
+		if e.Stage != "" {
+			label = e.Stage + " " + e.Phase
+		}
+		switch e.Type {
+		case WorkerJoined:
+			addWorker(e.Worker)
+		case TaskAssigned, TaskReassigned:
+			addWorker(e.Worker)
+			open[key] = location{e.Worker, len(bars[e.Worker])}
+			bars[e.Worker] = append(bars[e.Worker], timelineBar{
+				Label:  fmt.Sprintf("%s %d #%d", label, e.Task, e.Attempt),
+				Start:  at,
+				End:    tl.Total,
+				Result: "running",
+			})
+		case TaskFinished, TaskFailed, TaskRequeued:
+			if loc, ok := open[key]; ok {
+				bar := &bars[loc.worker][loc.index]
+				bar.End = at
+				bar.Result = strings.TrimPrefix(e.Type, "task ")
+				delete(open, key)
+			}
+		case PhaseChanged:
+			tl.Phases = append(tl.Phases, timelineMark{Label: label, At: at})
+		}
+	}
+
+	sort.Strings(workers)
+	for _, worker := range workers {
+		tl.Rows = append(tl.Rows, timelineRow{Worker: worker, Bars: bars[worker]})
+	}
+	return tl
+}
+
+// RenderTimeline renders the event log at path as a Gantt chart per worker, as text or html
+func RenderTimeline(w io.Writer, path, format string) error {
+	events, err := readEvents(path)
+	if err != nil {
+		return err
+	}
+	tl := buildTimeline(events)
+
+	switch format {
+	case "text":
+		tl.writeText(w)
+		return nil
+	case "html":
+		return timelinePage.Execute(w, tl)
+	}
+	return fmt.Errorf("unknown timeline format %q", format)
+}
+
+func (tl timeline) writeText(w io.Writer) {
+	column := func(d time.Duration) int {
+		if tl.Total <= 0 {
+			return 0
+		}
+		c := int(float64(d) / float64(tl.Total) * timelineWidth)
+		if c > timelineWidth-1 {
+			c = timelineWidth - 1
+		}
+		return c
+	}
+
+	fmt.Fprintf(w, "total %v\n", tl.Total.Round(time.Millisecond))
+	for _, mark := range tl.Phases {
+		fmt.Fprintf(w, "  %-24s %s^ %v\n", "phase "+mark.Label, strings.Repeat(" ", column(mark.At)), mark.At.Round(time.Millisecond))
+	}
+	for _, row := range tl.Rows {
+		fmt.Fprintf(w, "%s\n", row.Worker)
+		for _, bar := range row.Bars {
+			from, to := column(bar.Start), column(bar.End)
+			fill := "#"
+			if bar.Result == "failed" {
+				fill = "x"
+			} else if bar.Result == "requeued" {
+				fill = "-"
+			} else if bar.Result == "running" {
+				fill = "?"
+			}
+			line := strings.Repeat(".", from) + strings.Repeat(fill, to-from+1) + strings.Repeat(".", timelineWidth-to-1)
+			fmt.Fprintf(w, "  %-24s|%s| %v-%v %s\n", bar.Label, line, bar.Start.Round(time.Millisecond), bar.End.Round(time.Millisecond), bar.Result)
+		}
+	}
+}
+
+var timelinePage = template.Must(template.New("timeline").Funcs(template.FuncMap{
+	"percent": func(d, total time.Duration) string {
+		if total <= 0 {
+			return "0%"
+		}
+		return fmt.Sprintf("%.2f%%", float64(d)/float64(total)*100)
+	},
+	"width": func(start, end, total time.Duration) string {
+		if total <= 0 {
+			return "100%"
+		}
+		return fmt.Sprintf("%.2f%%", float64(end-start)/float64(total)*100)
+	},
+	"round": func(d time.Duration) time.Duration { return d.Round(time.Millisecond) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>MapReduce timeline</title>
+<style>
+body { font-family: sans-serif; }
+.row { display: flex; align-items: center; margin: 2px 0; }
+.label { width: 16em; font-size: small; }
+.track { position: relative; flex: 1; height: 1.4em; background: #f4f4f4; }
+.bar { position: absolute; top: 0; bottom: 0; font-size: x-small; overflow: hidden; white-space: nowrap; border-right: 1px solid #fff; }
+.finished { background: #7ab; }
+.failed { background: #d66; }
+.requeued { background: #db7; }
+.running { background: #ccc; }
+.phase { position: absolute; top: 0; bottom: 0; border-left: 1px dashed #333; font-size: x-small; }
+</style>
+</head>
+<body>
+<h1>MapReduce timeline ({{round .Total}})</h1>
+<div class="row"><div class="label">phases</div><div class="track">
+{{range .Phases}}<div class="phase" style="left: {{percent .At $.Total}}">{{.Label}}</div>
+{{end}}</div></div>
+{{range .Rows}}<div class="row"><div class="label">{{.Worker}}</div><div class="track">
+{{range .Bars}}<div class="bar {{.Result}}" style="left: {{percent .Start $.Total}}; width: {{width .Start .End $.Total}}" title="{{.Label}} {{round .Start}}-{{round .End}} {{.Result}}">{{.Label}}</div>
+{{end}}</div></div>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,167 @@
+package mapreduce
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// TraceContext links spans created on a worker to the master's trace. An empty TraceID means tracing is off.
+	TraceContext struct {
+		TraceID  string
+		ParentID string
+	}
+
+	// Span is a timed operation on some node
+	Span struct {
+		TraceID  string
+		ID       string
+		ParentID string `json:",omitempty"`
+		Name     string
+		Host     string
+		Start    time.Time
+		Duration time.Duration
+		Args     map[string]any `json:",omitempty"`
+	}
+
+	// Collects spans for one trace on one node. A nil tracer records nothing.
+	tracer struct {
+		ctx  TraceContext
+		host string
+
+		mu    sync.Mutex
+		spans []Span
+	}
+
+	// Chrome trace event format (https://docs.google.com/document/d/1CvAClvFfyA5R-PhYUmn5OOQtYMH4h6I0nSsKchNAySU)
+	chromeEvent struct {
+		Name  string         `json:"name"`
+		Cat   string         `json:"cat,omitempty"`
+		Phase string         `json:"ph"`
+		TS    int64          `json:"ts"` // Microseconds
+		Dur   int64          `json:"dur,omitempty"`
+		PID   int            `json:"pid"`
+		TID   int            `json:"tid"`
+		Args  map[string]any `json:"args,omitempty"`
+	}
+)
+
+func newSpanID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Returns a tracer continuing ctx on host, or nil if ctx is not traced
+func newTracer(ctx TraceContext, host string) *tracer {
+	if ctx.TraceID == "" {
+		return nil
+	}
+	return &tracer{ctx: ctx, host: host}
+}
+
+// Starts a span under the tracer's parent. Call the returned function to end it.
+func (t *tracer) start(name string, args ...any) func() {
+	return t.startSpan(newSpanID(), name, args...)
+}
+
+// Like start, with a span ID chosen up front (e.g. one handed out to workers as their parent)
+func (t *tracer) startSpan(id, name string, args ...any) func() {
+	if t == nil {
+		return func() {}
+	}
+	span := Span{
+		TraceID:  t.ctx.TraceID,
+		ID:       id,
+		ParentID: t.ctx.ParentID,
+		Name:     name,
+		Host:     t.host,
+		Start:    time.Now(),
+	}
+	if len(args) > 0 {
+		span.Args = make(map[string]any)
+		for i := 0; i+1 < len(args); i += 2 {
+			span.Args[fmt.Sprint(args[i])] = args[i+1]
+		}
+	}
+	return func() {
+		span.Duration = time.Since(span.Start)
+		t.add(span)
+	}
+}
+
+func (t *tracer) add(spans ...Span) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.spans = append(t.spans, spans...)
+	t.mu.Unlock()
+}
+
+// Returns a copy of the spans recorded so far
+func (t *tracer) collected() []Span {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Span(nil), t.spans...)
+}
+
+// Writes spans to path in the Chrome trace event format, one process per host and one thread per parent span
+func writeChromeTrace(path string, spans []Span) error {
+	sort.Slice(spans, func(i, j int) bool { return spans[i].Start.Before(spans[j].Start) })
+
+	pids := make(map[string]int)
+	tids := make(map[string]int)
+	var events []chromeEvent
+	for _, span := range spans {
+		pid, ok := pids[span.Host]
+		if !ok {
+			pid = len(pids) + 1
+			pids[span.Host] = pid
+			events = append(events, chromeEvent{Name: "process_name", Phase: "M", PID: pid, Args: map[string]any{"name": span.Host}})
+		}
+		tid, ok := tids[span.Host+"/"+span.ParentID]
+		if !ok {
+			tid = len(tids) + 1
+			tids[span.Host+"/"+span.ParentID] = tid
+		}
+
+		args := map[string]any{"span": span.ID}
+		if span.ParentID != "" {
+			args["parent"] = span.ParentID
+		}
+		for k, v := range span.Args {
+			args[k] = v
+		}
+		events = append(events, chromeEvent{
+			Name:  span.Name,
+			Cat:   "mapreduce",
+			Phase: "X",
+			TS:    span.Start.UnixMicro(),
+			Dur:   span.Duration.Microseconds(),
+			PID:   pid,
+			TID:   tid,
+			Args:  args,
+		})
+	}
+
+	data, err := json.Marshal(struct {
+		TraceEvents []chromeEvent `json:"traceEvents"`
+	}{events})
+	if err != nil {
+		return fmt.Errorf("encoding trace: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("writing trace: %v", err)
+	}
+	return nil
+}
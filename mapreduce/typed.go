@@ -0,0 +1,110 @@
+package mapreduce
+
+import (
+	"errors"
+	"fmt"
+)
+
+type (
+	// TypedJob adapts typed map and reduce functions to the string based Interface.
+	// Map input pairs are decoded with KeyIn/ValueIn, the intermediate pairs emitted by Mapper are encoded with
+	// KeyMid/ValueMid (which is also the output of a map-only job), and the pairs emitted by Reducer with
+	// KeyOut/ValueOut.
+	TypedJob[KIn, VIn, KMid, VMid, KOut, VOut any] struct {
+		Mapper  func(key KIn, value VIn, emit func(KMid, VMid) error) error
+		Reducer func(key KMid, values <-chan VMid, emit func(KOut, VOut) error) error
+
+		KeyIn    Codec[KIn]
+		ValueIn  Codec[VIn]
+		KeyMid   Codec[KMid]
+		ValueMid Codec[VMid]
+		KeyOut   Codec[KOut]
+		ValueOut Codec[VOut]
+	}
+)
+
+func (j *TypedJob[KIn, VIn, KMid, VMid, KOut, VOut]) Map(key, value string, output chan<- Pair) error {
+	defer close(output)
+	if j.Mapper == nil || j.KeyIn == nil || j.ValueIn == nil || j.KeyMid == nil || j.ValueMid == nil {
+		return errors.New("typed job is missing a mapper or codec")
+	}
+
+	k, err := j.KeyIn.Decode(key)
+	if err != nil {
+		return fmt.Errorf("decoding input key %q: %v", key, err)
+	}
+	v, err := j.ValueIn.Decode(value)
+	if err != nil {
+		return fmt.Errorf("decoding input value for key %q: %v", key, err)
+	}
+
+	return j.Mapper(k, v, emitter(output, j.KeyMid, j.ValueMid))
+}
+
+func (j *TypedJob[KIn, VIn, KMid, VMid, KOut, VOut]) Reduce(key string, values <-chan string, output chan<- Pair) error {
+	defer close(output)
+	if j.Reducer == nil || j.KeyMid == nil || j.ValueMid == nil || j.KeyOut == nil || j.ValueOut == nil {
+		drain(values)
+		return errors.New("typed job is missing a reducer or codec")
+	}
+
+	k, err := j.KeyMid.Decode(key)
+	if err != nil {
+		drain(values)
+		return fmt.Errorf("decoding key %q: %v", key, err)
+	}
+
+	// Decode values as the reducer consumes them. The input is always drained so the reader never blocks,
+	// even if the reducer returns early or a value fails to decode.
+	typed := make(chan VMid, 200)
+	stop := make(chan struct{})
+	decoded := make(chan error, 1)
+	go func() {
+		var decodeErr error
+		defer close(typed)
+		defer func() { decoded <- decodeErr }()
+		for value := range values {
+			if decodeErr != nil {
+				continue
+			}
+			v, err := j.ValueMid.Decode(value)
+			if err != nil {
+				decodeErr = fmt.Errorf("decoding value for key %q: %v", key, err)
+				continue
+			}
+			select {
+			case typed <- v:
+			case <-stop:
+			}
+		}
+	}()
+
+	err = j.Reducer(k, typed, emitter(output, j.KeyOut, j.ValueOut))
+	close(stop)
+	if decodeErr := <-decoded; decodeErr != nil {
+		return decodeErr
+	}
+	return err
+}
+
+// Encodes typed pairs onto the output channel
+func emitter[K, V any](output chan<- Pair, keys Codec[K], values Codec[V]) func(K, V) error {
+	return func(key K, value V) error {
+		k, err := keys.Encode(key)
+		if err != nil {
+			return fmt.Errorf("encoding output key: %v", err)
+		}
+		v, err := values.Encode(value)
+		if err != nil {
+			return fmt.Errorf("encoding output value: %v", err)
+		}
+		output <- Pair{Key: k, Value: v}
+		return nil
+	}
+}
+
+// Discards everything left on a channel
+func drain(values <-chan string) {
+	for range values {
+	}
+}
@@ -1,10 +1,12 @@
 package mapreduce
 
 import (
+	"errors"
 	"fmt"
 	"io/fs"
-	"log"
+	"net/url"
 	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -12,44 +14,54 @@ const (
 	requestInterval = 100 // Milliseconds
 )
 
-func startWorker(client Interface) error {
+func startWorker(cfg *Config, stages []Stage) error {
+	cfg = cfg.with("worker", cfg.Host)
+
+	// Tasks name the stage whose client runs them
+	clients := make(map[string]Interface)
+	for _, stage := range stages {
+		clients[stage.Name] = stage.Client
+	}
+
 	// Start an HTTP server to serve intermediate data files to other workers and back to the master.
-	if err := os.Mkdir(tempdir, fs.ModePerm); err != nil {
+	if err := os.Mkdir(cfg.Tempdir, fs.ModePerm); err != nil {
 		return fmt.Errorf("creating temp dir: %v", err)
 	}
-	defer os.RemoveAll(tempdir)
-
-	go localServe(host, tempdir)
+	defer os.RemoveAll(cfg.Tempdir)
 
 	workerNode := Node{
 		Done: make(chan JobDone, 1),
+		cfg:  cfg,
 	}
-	_, err := workerNode.startRPC()
+	actor, err := workerNode.startRPC()
 	if err != nil {
 		return fmt.Errorf("can't start RPC server: %v", err)
 	}
 
+	go cfg.localServe()
+
 	// Notify master
 	var wait bool
-	if err := call(masterAddr, "NodeActor.Ping", host, &wait); err != nil {
+	if err := cfg.call(cfg.MasterAddr, "NodeActor.Ping", cfg.Host, &wait); err != nil {
 		return fmt.Errorf("connecting to master: %v", err)
 	}
 	if wait {
 		// Wait for master to start the worker
-		log.Println("Waiting for master to start...")
+		cfg.Logger.Info("waiting for master to start")
 		<-workerNode.Done
 	}
 
 	ticker := time.NewTicker(time.Millisecond * requestInterval)
 
 	lastPhase := Wait
+	lastJob := "" // Job of the last task, whose files are kept until a task of another job arrives
 
 	// Label to break out of nested scopes
 JobLoop:
 	for range ticker.C {
 		// Request a job from the master.
 		var job Job
-		if err := call(masterAddr, "NodeActor.RequestJob", host, &job); err != nil {
+		if err := cfg.call(cfg.MasterAddr, "NodeActor.RequestJob", cfg.Host, &job); err != nil {
 			if lastPhase >= ReduceDone {
 				break JobLoop
 			}
@@ -58,30 +70,86 @@ JobLoop:
 
 		// Determine type of task and process accordingly
 		if !job.Wait {
-			if job.Phase == Map {
+			// A coordinator runs jobs one after another, so earlier jobs are done with
+			if id := job.jobID(); id != lastJob {
+				if lastJob != "" {
+					if err := os.RemoveAll(filepath.Join(cfg.Tempdir, lastJob)); err != nil {
+						cfg.Logger.Warn("error removing files of earlier job", "old_job", lastJob, "err", err)
+					}
+					cfg.cache.forget(lastJob)
+				}
+				lastJob = id
+			}
+
+			// Backups are handed out after the phase moved on, so go by the task
+			if job.MapTask != nil {
 				task := job.MapTask
-				log.Printf("Received map task %d. Processing...\n", task.N)
-				if err := task.Process(tempdir, client); err != nil {
-					return fmt.Errorf("map job: %v", err)
+				client, ok := clients[task.Stage]
+				if !ok {
+					return fmt.Errorf("map task of unknown stage %q, start workers with the same stages as the master", task.Stage)
+				}
+				tcfg := cfg.with("job", task.Job, "phase", Map.String(), "task", task.N, "attempt", task.Attempt)
+				if task.Stage != "" {
+					tcfg = tcfg.with("stage", task.Stage)
+				}
+				tcfg.Logger = actor.captureTaskLog(TaskRef{Job: task.Job, Stage: task.Stage, Phase: Map, Number: task.N}, task.Attempt, tcfg.Logger)
+				tcfg.Logger.Info("received map task")
+				tcfg.spans = newTracer(job.Trace, cfg.Host)
+				tcfg.progress = new(taskProgress)
+				stopProgress := tcfg.reportProgress(Progress{Job: task.Job, Stage: task.Stage, Phase: Map, Number: task.N, Attempt: task.Attempt})
+				start := time.Now()
+				result, err := task.Process(tcfg, client)
+				stopProgress()
+				taskDuration.observe(time.Since(start).Seconds(), Map.String())
+				if errors.Is(err, errAbandoned) {
+					tcfg.Logger.Info("map task abandoned, the master no longer needs it")
+					continue JobLoop
 				}
-				result := JobDone{
-					Number: task.N,
-					Addr:   host,
+				if err != nil {
+					tasksFailed.add(1, Map.String())
+					tcfg.reportCorruption(err)
+					tcfg.reportFailure(TaskFailure{Job: task.Job, Stage: task.Stage, Phase: Map, Number: task.N, Attempt: task.Attempt}, err)
+					// The master assigns the task again, this worker goes on with other tasks
+					continue JobLoop
 				}
-				if err := call(masterAddr, "NodeActor.FinishJob", result, nil); err != nil {
+				result.Addr = cfg.Host
+				result.Spans = tcfg.spans.collected()
+				if err := cfg.call(cfg.MasterAddr, "NodeActor.FinishJob", result, nil); err != nil {
 					return fmt.Errorf("finishing map job: %v", err)
 				}
 			} else {
 				task := job.ReduceTask
-				log.Printf("Received reduce task %d. Processing...\n", task.N)
-				if err = task.Process(tempdir, client); err != nil {
-					return fmt.Errorf("reduce job: %v", err)
+				client, ok := clients[task.Stage]
+				if !ok {
+					return fmt.Errorf("reduce task of unknown stage %q, start workers with the same stages as the master", task.Stage)
 				}
-				result := JobDone{
-					Number: task.N,
-					Addr:   host,
+				tcfg := cfg.with("job", task.Job, "phase", Reduce.String(), "task", task.N, "attempt", task.Attempt)
+				if task.Stage != "" {
+					tcfg = tcfg.with("stage", task.Stage)
 				}
-				if err := call(masterAddr, "NodeActor.FinishJob", result, nil); err != nil {
+				tcfg.Logger = actor.captureTaskLog(TaskRef{Job: task.Job, Stage: task.Stage, Phase: Reduce, Number: task.N}, task.Attempt, tcfg.Logger)
+				tcfg.Logger.Info("received reduce task")
+				tcfg.spans = newTracer(job.Trace, cfg.Host)
+				tcfg.progress = new(taskProgress)
+				stopProgress := tcfg.reportProgress(Progress{Job: task.Job, Stage: task.Stage, Phase: Reduce, Number: task.N, Attempt: task.Attempt})
+				start := time.Now()
+				result, err := task.Process(tcfg, client)
+				stopProgress()
+				taskDuration.observe(time.Since(start).Seconds(), Reduce.String())
+				if errors.Is(err, errAbandoned) {
+					tcfg.Logger.Info("reduce task abandoned, the master no longer needs it")
+					continue JobLoop
+				}
+				if err != nil {
+					tasksFailed.add(1, Reduce.String())
+					tcfg.reportCorruption(err)
+					tcfg.reportFailure(TaskFailure{Job: task.Job, Stage: task.Stage, Phase: Reduce, Number: task.N, Attempt: task.Attempt}, err)
+					// The master assigns the task again, this worker goes on with other tasks
+					continue JobLoop
+				}
+				result.Addr = cfg.Host
+				result.Spans = tcfg.spans.collected()
+				if err := cfg.call(cfg.MasterAddr, "NodeActor.FinishJob", result, nil); err != nil {
 					return fmt.Errorf("finishing reduce job: %v", err)
 				}
 			}
@@ -90,20 +158,61 @@ JobLoop:
 			if job.Phase != lastPhase {
 				switch job.Phase {
 				case MapDone:
-					log.Println("Waiting for map jobs to finish...")
+					cfg.Logger.Info("waiting for map jobs to finish")
 				case ReduceDone:
-					log.Println("Waiting for reduce jobs to finish...")
+					cfg.Logger.Info("waiting for reduce jobs to finish")
 				default:
-					break JobLoop
+					if !job.Persistent {
+						break JobLoop
+					}
 				}
 			}
 		}
 		lastPhase = job.Phase
 	}
 
-	log.Println("Waiting for master to finish...")
+	cfg.Logger.Info("waiting for master to finish")
 	<-workerNode.Done
 
-	log.Println("Shutting down...")
+	cfg.Logger.Info("shutting down")
 	return nil
 }
+
+// Returns the ID of the job the task belongs to
+func (job Job) jobID() string {
+	if job.MapTask != nil {
+		return job.MapTask.Job
+	}
+	return job.ReduceTask.Job
+}
+
+// Tells the master a task attempt failed, so it can assign the task again
+func (cfg *Config) reportFailure(f TaskFailure, err error) {
+	f.Addr, f.Error = cfg.Host, err.Error()
+	var failed *DownloadError
+	if errors.As(err, &failed) {
+		if u, err := url.Parse(failed.URL); err == nil {
+			f.Unreachable = u.Host
+		}
+	}
+	if err := cfg.call(cfg.MasterAddr, "NodeActor.FailJob", f, nil); err != nil {
+		cfg.Logger.Warn("error reporting task failure to master", "err", err)
+	}
+}
+
+// Tells the master about corrupt downloads behind a task failure
+func (cfg *Config) reportCorruption(err error) {
+	var corrupt *CorruptionError
+	if !errors.As(err, &corrupt) {
+		return
+	}
+	report := Corruption{
+		Addr:     cfg.Host,
+		URL:      corrupt.URL,
+		Expected: corrupt.Expected,
+		Got:      corrupt.Got,
+	}
+	if err := cfg.call(cfg.MasterAddr, "NodeActor.ReportCorruption", report, nil); err != nil {
+		cfg.Logger.Warn("error reporting corruption to master", "err", err)
+	}
+}